@@ -7,8 +7,10 @@ require (
 	github.com/corona10/goimagehash v1.1.0
 	github.com/go-faster/errors v0.7.1
 	github.com/go-telegram/bot v1.19.0
+	github.com/lib/pq v1.10.9
 	github.com/mattn/go-sqlite3 v1.14.34
 	go.uber.org/zap v1.27.1
+	golang.org/x/image v0.30.0
 )
 
 require (
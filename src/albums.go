@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-faster/errors"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"github.com/sleroq/bayan/src/storage"
+	"go.uber.org/zap"
+	"sort"
+	"sync"
+	"time"
+)
+
+// albumDelay is how long to wait for more items after the last one.
+// Telegram sends items of an album one right after another.
+const albumDelay = 2 * time.Second
+
+type album struct {
+	messages []*models.Message
+	timer    *time.Timer
+}
+
+// albumBuffer collects items of media groups, so the whole album gets one reply
+type albumBuffer struct {
+	mu     sync.Mutex
+	albums map[string]*album
+}
+
+type albumRepost struct {
+	// label tells what was reposted: the position of an item, the links or a caption of the album
+	label   string
+	similar []*match
+	cluster *storage.Cluster
+}
+
+func (b *BayanBot) bufferAlbumItem(ctx context.Context, api *bot.Bot, msg *models.Message) {
+	b.albums.mu.Lock()
+	defer b.albums.mu.Unlock()
+
+	key := fmt.Sprintf("%d/%s", msg.Chat.ID, msg.MediaGroupID)
+	a, ok := b.albums.albums[key]
+	if !ok {
+		a = &album{}
+		a.timer = time.AfterFunc(albumDelay, func() {
+			b.flushAlbum(ctx, api, key)
+		})
+		b.albums.albums[key] = a
+	} else {
+		a.timer.Reset(albumDelay)
+	}
+
+	a.messages = append(a.messages, msg)
+}
+
+func (b *BayanBot) flushAlbum(ctx context.Context, api *bot.Bot, key string) {
+	b.albums.mu.Lock()
+	a, ok := b.albums.albums[key]
+	delete(b.albums.albums, key)
+	b.albums.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	sort.Slice(a.messages, func(i, j int) bool {
+		return a.messages[i].ID < a.messages[j].ID
+	})
+
+	err := b.processAlbum(ctx, api, a.messages)
+	if err != nil {
+		b.logger.Error("failed to process album", zap.Error(err))
+	}
+}
+
+// findAlbumItem returns nil save func for items that are not checked
+func (b *BayanBot) findAlbumItem(ctx context.Context, api *bot.Bot, msg *models.Message) (similar []*match, save func() error, err error) {
+	switch {
+	case msg.Photo != nil:
+		return b.findPicture(ctx, api, msg, pictureFromPhoto(msg.Photo[0]))
+	case msg.Video != nil:
+		return b.findVideo(ctx, api, msg, videoFromVideo(msg.Video))
+	case msg.Audio != nil:
+		return b.findAudio(ctx, api, msg, audioFromAudio(msg.Audio))
+	case msg.Voice != nil:
+		return b.findAudio(ctx, api, msg, audioFromVoice(msg.Voice))
+	case msg.Document != nil:
+		pic, video := documentFiles(msg.Document)
+		if pic != nil {
+			return b.findPicture(ctx, api, msg, pic)
+		}
+		if video != nil {
+			return b.findVideo(ctx, api, msg, video)
+		}
+	}
+
+	return nil, nil, nil
+}
+
+// processAlbum checks every item before saving any of them,
+// so similar items of the same album don't match each other
+func (b *BayanBot) processAlbum(ctx context.Context, api *bot.Bot, messages []*models.Message) error {
+	var reposts []albumRepost
+	var saves []func() error
+	for i, msg := range messages {
+		similar, save, err := b.findAlbumItem(ctx, api, msg)
+		if err != nil {
+			b.logMediaError("failed to process album item", err)
+			continue
+		}
+
+		if save == nil {
+			continue
+		}
+		saves = append(saves, save)
+
+		if len(similar) > 0 {
+			reposts = append(reposts, albumRepost{
+				label:   fmt.Sprintf("%d.", i+1),
+				similar: similar,
+				cluster: b.recordRepost(msg, similar),
+			})
+		}
+	}
+
+	// Items that failed or were not checked keep the album from being a whole repost
+	whole := len(reposts) == len(messages)
+
+	// Links are usually in the caption of one item, the first repost of them is enough
+	var linksReposted bool
+	for _, msg := range messages {
+		similar, save, err := b.findLinks(msg)
+		if err != nil {
+			b.logger.Error("failed to process links", zap.Error(err))
+			continue
+		}
+
+		if save == nil {
+			continue
+		}
+		saves = append(saves, save)
+
+		if len(similar) > 0 && !linksReposted {
+			linksReposted = true
+			reposts = append(reposts, albumRepost{
+				label:   "Ссылка:",
+				similar: similar,
+				cluster: b.recordRepost(msg, similar),
+			})
+		}
+	}
+
+	// A caption of the whole album can come with every item, it's checked and saved once
+	captions := make(map[string]bool)
+	for _, msg := range messages {
+		if !b.isLongText(msg.Caption) || captions[msg.Caption] {
+			continue
+		}
+		captions[msg.Caption] = true
+
+		similar, save, err := b.findText(msg)
+		if err != nil {
+			b.logger.Error("failed to process text", zap.Error(err))
+			continue
+		}
+		saves = append(saves, save)
+
+		if len(similar) > 0 {
+			reposts = append(reposts, albumRepost{
+				label:   "Подпись:",
+				similar: similar,
+				cluster: b.recordRepost(msg, similar),
+			})
+		}
+	}
+
+	if len(reposts) > 0 {
+		err := b.replyAlbum(ctx, api, messages[0], reposts, whole)
+		if err != nil {
+			return errors.Wrap(err, "failed to reply album")
+		}
+	}
+
+	for _, save := range saves {
+		err := save()
+		if err != nil {
+			return errors.Wrap(err, "failed to save album item")
+		}
+	}
+
+	return nil
+}
+
+func (b *BayanBot) replyAlbum(ctx context.Context, api *bot.Bot, msg *models.Message, reposts []albumRepost, whole bool) error {
+	text := "Баяны в альбоме:\n"
+	if whole {
+		text = "Весь альбом - баян:\n"
+	}
+
+	for _, r := range reposts {
+		text += fmt.Sprintf("%s %s%s\n", r.label, b.bayanLinks(r.similar), clusterCount(r.cluster))
+	}
+
+	_, err := api.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID:          msg.Chat.ID,
+		Text:            text,
+		ReplyParameters: &models.ReplyParameters{MessageID: msg.ID},
+		ParseMode:       models.ParseModeMarkdown,
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to send message")
+	}
+
+	return nil
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"github.com/go-faster/errors"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"github.com/sleroq/bayan/src/audio"
+	"github.com/sleroq/bayan/src/storage"
+	"go.uber.org/zap"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// maxAudioDuration limits how many seconds of long tracks are fingerprinted
+const maxAudioDuration = 180
+
+// Distances of unrelated videos: about half of the bits differ in both frame hashes and audio fingerprints
+const (
+	randomVisualDistance = 32
+	randomAudioDistance  = 50
+)
+
+// audioWeight is how much more the sound counts than the frames. Sound matches
+// at any offset, while frames are compared by position and miss re-cut clips.
+const audioWeight = 3
+
+// sameSoundDistance is the bit error rate, in percents, under which the sound is surely the same
+// recording. Then the sound alone is enough: frames of a re-cut clip may look unrelated.
+const sameSoundDistance = 15
+
+// sameSoundLimit is how many videos with the same sound are checked without close frames
+const sameSoundLimit = 10
+
+// audioFile is the part of voice messages and audio files needed to fingerprint them.
+type audioFile struct {
+	FileID   string
+	FileSize int64
+	Duration int
+	Media    storage.Media
+}
+
+func audioFromVoice(voice *models.Voice) *audioFile {
+	return &audioFile{
+		FileID:   voice.FileID,
+		FileSize: voice.FileSize,
+		Duration: voice.Duration,
+		Media: storage.Media{
+			Kind:         storage.KindAudio,
+			FileUniqueID: voice.FileUniqueID,
+		},
+	}
+}
+
+func audioFromAudio(a *models.Audio) *audioFile {
+	return &audioFile{
+		FileID:   a.FileID,
+		FileSize: a.FileSize,
+		Duration: a.Duration,
+		Media: storage.Media{
+			Kind:         storage.KindAudio,
+			FileUniqueID: a.FileUniqueID,
+		},
+	}
+}
+
+// extractSamples decodes audio, or the audio track of a video, to mono samples with ffmpeg
+func extractSamples(ctx context.Context, path string) ([]float64, error) {
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, "ffmpeg",
+		"-i", path,
+		"-t", strconv.Itoa(maxAudioDuration),
+		"-vn",
+		"-ac", "1",
+		"-ar", strconv.Itoa(audio.SampleRate),
+		"-f", "s16le",
+		"-",
+	)
+	cmd.Stdout = &out
+	err := cmd.Run()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode audio")
+	}
+
+	pcm := make([]int16, out.Len()/2)
+	err = binary.Read(&out, binary.LittleEndian, pcm)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read samples")
+	}
+
+	samples := make([]float64, len(pcm))
+	for i, sample := range pcm {
+		samples[i] = float64(sample) / math.MaxInt16
+	}
+
+	return samples, nil
+}
+
+// fingerprintAudio returns the fingerprint and the hex encoded SHA-256 of the file
+func (b *BayanBot) fingerprintAudio(ctx context.Context, api *bot.Bot, file *audioFile) ([]uint32, string, error) {
+	body, err := b.downloadFile(ctx, api, file.FileID)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "failed to download file")
+	}
+	defer body.Close()
+
+	// Some containers can't be decoded from a pipe, so the file is saved first
+	f, err := os.CreateTemp("", "bayan-audio-*")
+	if err != nil {
+		return nil, "", errors.Wrap(err, "failed to create file")
+	}
+	defer func() {
+		rmErr := os.Remove(f.Name())
+		if rmErr != nil {
+			b.logger.Error("failed to remove temp file", zap.Error(rmErr))
+		}
+	}()
+
+	checksum := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, checksum), body)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "failed to copy file")
+	}
+
+	err = f.Close()
+	if err != nil {
+		return nil, "", errors.Wrap(err, "failed to close file")
+	}
+
+	samples, err := extractSamples(ctx, f.Name())
+	if err != nil {
+		return nil, "", errors.Wrap(err, "failed to extract samples")
+	}
+
+	return audio.Fingerprint(samples), hex.EncodeToString(checksum.Sum(nil)), nil
+}
+
+// audioDistance is the bit error rate of the best overlap in percents
+func audioDistance(a, b []uint32) (dist int, ok bool) {
+	ber, _, ok := audio.Match(a, b)
+	if !ok {
+		return 0, false
+	}
+
+	return int(ber * 100), true
+}
+
+// combinedDistance mixes the average frame distance with the distance of the sound,
+// so the same picture with different sound is not a match, and a re-cut clip with
+// the same sound is. The distance of the same sound is never exceeded, see sameSoundDistance.
+// Videos without sound are compared by frames only.
+func combinedDistance(visual int, stored []uint32, track *storage.AudioTrack) int {
+	if track == nil || len(stored) == 0 {
+		return visual
+	}
+
+	audioDist, ok := audioDistance(stored, track.Fingerprint)
+	if !ok {
+		return visual
+	}
+
+	scaled := scaledAudioDistance(audioDist)
+	combined := (visual + audioWeight*scaled) / (1 + audioWeight)
+
+	if audioDist < sameSoundDistance {
+		return min(combined, scaled)
+	}
+	return combined
+}
+
+// scaledAudioDistance scales the audio distance to the range of frame hashes
+func scaledAudioDistance(audioDist int) int {
+	return audioDist * randomVisualDistance / randomAudioDistance
+}
+
+// findSameSound finds videos with surely the same sound, closest first, see sameSoundDistance.
+// The audio distances are not scaled. Videos without sound get none.
+func (b *BayanBot) findSameSound(chatID int64, kind storage.MediaKind, track *storage.AudioTrack) ([]*storage.SimilarMessage, error) {
+	if track == nil {
+		return nil, nil
+	}
+
+	return b.store.FindMsgAudioFilter(chatID, kind, sameSoundLimit, func(m *storage.MessageAudio) (dist int, ok bool, err error) {
+		dist, ok = audioDistance(m.Fingerprint, track.Fingerprint)
+		return dist, ok && dist < sameSoundDistance, nil
+	})
+}
+
+func (b *BayanBot) findAudio(ctx context.Context, api *bot.Bot, msg *models.Message, file *audioFile) (similar []*match, save func() error, err error) {
+	similar, save, err = b.findExact(msg, file.Media)
+	if err != nil || similar != nil {
+		return similar, save, err
+	}
+
+	if file.FileSize > maxDownloadSize {
+		return nil, func() error { return nil }, nil
+	}
+
+	fingerprint, sum, err := b.fingerprintAudio(ctx, api, file)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to fingerprint audio")
+	}
+
+	if len(fingerprint) == 0 {
+		return nil, func() error { return nil }, nil
+	}
+
+	media := file.Media
+	media.SHA256 = sum
+	save = func() error {
+		err := b.store.SaveMessageAudio(msg, media, &storage.AudioTrack{
+			Duration:    file.Duration,
+			Fingerprint: fingerprint,
+		})
+		if err != nil {
+			return errors.Wrap(err, "failed to save message")
+		}
+
+		return nil
+	}
+
+	// Same bytes under a different telegram file
+	same, err := b.store.FindMsgBySHA256(msg.Chat.ID, media.Kind, sum)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to find same file")
+	}
+
+	if same != nil {
+		return detectedBy(matched(same), media.Kind, storage.AlgorithmSHA256, 0), save, nil
+	}
+
+	threshold, err := b.threshold(msg.Chat.ID, mediaOf(media.Kind, false))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	found, err := b.store.FindMsgAudioFilter(msg.Chat.ID, file.Media.Kind, 0, func(m *storage.MessageAudio) (dist int, ok bool, err error) {
+		dist, ok = audioDistance(m.Fingerprint, fingerprint)
+		return dist, ok && dist < searchThreshold(threshold), nil
+	})
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to find similar messages")
+	}
+	similar = b.splitByConfidence(msg, detectedBy(matched(found...), file.Media.Kind, storage.AlgorithmAudio, threshold))
+
+	b.logSimilar(similar)
+
+	return similar, save, nil
+}
+
+func (b *BayanBot) processAudio(ctx context.Context, api *bot.Bot, msg *models.Message, file *audioFile) error {
+	similar, save, err := b.findAudio(ctx, api, msg, file)
+	if err != nil {
+		return err
+	}
+
+	if len(similar) > 0 {
+		err := b.replyBayan(ctx, api, msg, similar...)
+		if err != nil {
+			return errors.Wrap(err, "failed to reply bayan")
+		}
+	}
+
+	return save()
+}
+
+func (b *BayanBot) compareAudio(ctx context.Context, api *bot.Bot, msg *models.Message, file *audioFile) error {
+	if file.FileSize > maxDownloadSize {
+		b.reply(ctx, api, msg, "Файл слишком большой")
+		return nil
+	}
+
+	fingerprint, _, err := b.fingerprintAudio(ctx, api, file)
+	if err != nil {
+		return errors.Wrap(err, "failed to fingerprint audio")
+	}
+
+	threshold, err := b.threshold(msg.Chat.ID, mediaOf(file.Media.Kind, false))
+	if err != nil {
+		return err
+	}
+
+	// Will find all similar messages
+	similar, err := b.store.FindMsgAudioFilter(msg.Chat.ID, file.Media.Kind, 0, func(m *storage.MessageAudio) (dist int, ok bool, err error) {
+		if m.Msg.ID == msg.ReplyToMessage.ID {
+			return 0, false, nil
+		}
+
+		dist, ok = audioDistance(m.Fingerprint, fingerprint)
+		return dist, ok && dist < threshold, nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to find similar messages")
+	}
+
+	if len(similar) > 0 {
+		err := b.replySimilar(ctx, api, msg, matched(similar...))
+		if err != nil {
+			return errors.Wrap(err, "failed to reply bayan")
+		}
+	} else {
+		b.reply(ctx, api, msg, "Похожих постов не видел")
+	}
+
+	return nil
+}
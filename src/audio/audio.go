@@ -0,0 +1,181 @@
+// Package audio computes acoustic fingerprints that survive re-encoding and trimming.
+//
+// The fingerprint is a sequence of 32-bit sub-fingerprints, one per frame, in the spirit
+// of Chromaprint and the Philips robust hash: each bit tells whether the energy difference
+// between two neighbouring frequency bands grew or shrank since the previous frame.
+// Signs of energy changes are kept by lossy codecs, so the same clip gets almost the
+// same bits after re-encoding.
+package audio
+
+import (
+	"math"
+	"math/bits"
+	"math/cmplx"
+	"sort"
+)
+
+const (
+	// SampleRate is the rate the samples passed to Fingerprint must have
+	SampleRate = 5512
+	frameSize  = 2048
+	// hopSize of 256 samples gives about 21 sub-fingerprints per second
+	hopSize = 256
+	bands   = 33
+	minFreq = 300
+	maxFreq = 2000
+
+	// minOverlap is about 5 seconds, shorter overlaps match by chance too often
+	minOverlap = 5 * SampleRate / hopSize
+	// sampleStep is the step between frames compared when looking for the best offsets
+	sampleStep = 4
+	// candidateOffsets is how many of the best sampled offsets are compared frame by frame
+	candidateOffsets = 5
+)
+
+// FramesPerSecond converts offsets returned by Match to seconds
+const FramesPerSecond = float64(SampleRate) / hopSize
+
+// Fingerprint returns one sub-fingerprint per frame of mono samples in [-1, 1] range
+func Fingerprint(samples []float64) []uint32 {
+	window := hannWindow(frameSize)
+	edges := bandEdges()
+
+	var fingerprint []uint32
+	var prev []float64
+	frame := make([]complex128, frameSize)
+	for start := 0; start+frameSize <= len(samples); start += hopSize {
+		for i := range frame {
+			frame[i] = complex(samples[start+i]*window[i], 0)
+		}
+		fft(frame)
+
+		energy := make([]float64, bands)
+		for band := 0; band < bands; band++ {
+			for bin := edges[band]; bin < edges[band+1]; bin++ {
+				energy[band] += real(frame[bin])*real(frame[bin]) + imag(frame[bin])*imag(frame[bin])
+			}
+		}
+
+		if prev != nil {
+			var sub uint32
+			for band := 0; band < 32; band++ {
+				diff := (energy[band] - energy[band+1]) - (prev[band] - prev[band+1])
+				if diff > 0 {
+					sub |= 1 << band
+				}
+			}
+			fingerprint = append(fingerprint, sub)
+		}
+		prev = energy
+	}
+
+	return fingerprint
+}
+
+// Match finds where b overlaps a best, so trimmed clips and clips with an intro still match.
+// It returns the bit error rate in the overlap (0 means identical, about 0.5 means unrelated)
+// and the offset of b in a in frames. ok is false if the clips can't overlap long enough,
+// clips shorter than minOverlap are never matched, identical files are found by checksums instead.
+func Match(a, b []uint32) (ber float64, offset int, ok bool) {
+	need := minOverlap
+	if len(a) < need || len(b) < need {
+		return 0, 0, false
+	}
+
+	// Every offset is checked on a sample of frames first, only the best ones are checked fully
+	type candidate struct {
+		offset int
+		ber    float64
+	}
+	var candidates []candidate
+	for offset := need - len(b); offset <= len(a)-need; offset++ {
+		candidateBER, _ := bitErrorRate(a, b, offset, sampleStep)
+		candidates = append(candidates, candidate{offset: offset, ber: candidateBER})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].ber < candidates[j].ber
+	})
+	if len(candidates) > candidateOffsets {
+		candidates = candidates[:candidateOffsets]
+	}
+
+	ber = 1
+	for _, c := range candidates {
+		candidateBER, overlap := bitErrorRate(a, b, c.offset, 1)
+		if overlap < need || candidateBER >= ber {
+			continue
+		}
+
+		ber = candidateBER
+		offset = c.offset
+		ok = true
+	}
+
+	return ber, offset, ok
+}
+
+// bitErrorRate compares b placed at the offset in a, using every step-th frame of the overlap
+func bitErrorRate(a, b []uint32, offset, step int) (ber float64, overlap int) {
+	start := max(0, -offset)
+	end := min(len(b), len(a)-offset)
+	if end <= start {
+		return 1, 0
+	}
+
+	differentBits, compared := 0, 0
+	for j := start; j < end; j += step {
+		differentBits += bits.OnesCount32(a[j+offset] ^ b[j])
+		compared++
+	}
+
+	return float64(differentBits) / float64(compared*32), end - start
+}
+
+func hannWindow(size int) []float64 {
+	window := make([]float64, size)
+	for i := range window {
+		window[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(size-1))
+	}
+	return window
+}
+
+// bandEdges splits the minFreq..maxFreq range into logarithmically spaced bands of fft bins
+func bandEdges() []int {
+	edges := make([]int, bands+1)
+	ratio := math.Pow(float64(maxFreq)/minFreq, 1/float64(bands))
+	freq := float64(minFreq)
+	for i := range edges {
+		edges[i] = int(math.Round(freq * frameSize / SampleRate))
+		freq *= ratio
+	}
+	return edges
+}
+
+// fft is an in-place iterative radix-2 fft, len(x) must be a power of two
+func fft(x []complex128) {
+	n := len(x)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+
+	for size := 2; size <= n; size <<= 1 {
+		step := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				even := x[start+k]
+				odd := w * x[start+k+size/2]
+				x[start+k] = even + odd
+				x[start+k+size/2] = even - odd
+				w *= step
+			}
+		}
+	}
+}
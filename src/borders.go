@@ -0,0 +1,167 @@
+package main
+
+import (
+	"github.com/corona10/goimagehash"
+	"github.com/go-faster/errors"
+	"github.com/sleroq/bayan/src/storage"
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+const (
+	// borderTolerance is how much a channel of a border pixel may differ from the border color, out of 0xffff.
+	// JPEG artifacts make even solid bars a bit noisy.
+	borderTolerance = 0x1800
+	// borderOutliers is the share of pixels of a border line that may differ more, in percents
+	borderOutliers = 2
+	// minTrimmedShare is how much of each side has to be left after trimming, in percents.
+	// Images that are mostly one color are not trimmed.
+	minTrimmedShare = 25
+)
+
+// cropShares are the center crops hashed besides the whole picture, in percents of its sides.
+// A slightly cropped repost is close to one of the crops of the original, and the other way round.
+var cropShares = []int{90, 80, 70}
+
+func closeColors(a, b color.Color) bool {
+	r1, g1, b1, _ := a.RGBA()
+	r2, g2, b2, _ := b.RGBA()
+	near := func(x, y uint32) bool {
+		if x > y {
+			return x-y <= borderTolerance
+		}
+		return y-x <= borderTolerance
+	}
+	return near(r1, r2) && near(g1, g2) && near(b1, b2)
+}
+
+// uniformLine checks if the pixels from start to end, one step apart, have the border color
+func uniformLine(img image.Image, border color.Color, start, end, step image.Point) bool {
+	total, outliers := 0, 0
+	for p := start; p != end; p = p.Add(step) {
+		total++
+		if !closeColors(img.At(p.X, p.Y), border) {
+			outliers++
+		}
+	}
+	return outliers*100 <= total*borderOutliers
+}
+
+// Sides of an image, in the order they are trimmed
+const (
+	sideTop = iota
+	sideBottom
+	sideLeft
+	sideRight
+)
+
+// borderLine returns the outer line of the side of rect: its ends and the step between pixels
+func borderLine(rect image.Rectangle, side int) (start, end, step image.Point) {
+	switch side {
+	case sideTop:
+		return rect.Min, image.Pt(rect.Max.X, rect.Min.Y), image.Pt(1, 0)
+	case sideBottom:
+		return image.Pt(rect.Min.X, rect.Max.Y-1), image.Pt(rect.Max.X, rect.Max.Y-1), image.Pt(1, 0)
+	case sideLeft:
+		return rect.Min, image.Pt(rect.Min.X, rect.Max.Y), image.Pt(0, 1)
+	default:
+		return image.Pt(rect.Max.X-1, rect.Min.Y), rect.Max.Sub(image.Pt(1, 0)), image.Pt(0, 1)
+	}
+}
+
+// cutLine removes the outer line of the side from rect
+func cutLine(rect image.Rectangle, side int) image.Rectangle {
+	switch side {
+	case sideTop:
+		rect.Min.Y++
+	case sideBottom:
+		rect.Max.Y--
+	case sideLeft:
+		rect.Min.X++
+	default:
+		rect.Max.X--
+	}
+	return rect
+}
+
+// trimBorders cuts off uniform bars on the sides of the image, like letterboxing
+// or padding around memes. The color of a bar is taken from the middle of its outer line.
+// Sides are trimmed until none changes, because a bar on one side covers the ends of the others.
+func trimBorders(img image.Image) image.Image {
+	bounds := img.Bounds()
+	rect := bounds
+	minWidth := bounds.Dx() * minTrimmedShare / 100
+	minHeight := bounds.Dy() * minTrimmedShare / 100
+
+	for changed := true; changed; {
+		changed = false
+		for side := sideTop; side <= sideRight; side++ {
+			start, end, _ := borderLine(rect, side)
+			middle := start.Add(end.Sub(start).Div(2))
+			border := img.At(middle.X, middle.Y)
+
+			for rect.Dx() > minWidth && rect.Dy() > minHeight {
+				start, end, step := borderLine(rect, side)
+				if !uniformLine(img, border, start, end, step) {
+					break
+				}
+				rect = cutLine(rect, side)
+				changed = true
+			}
+		}
+	}
+
+	if rect == bounds || rect.Dx() <= minWidth || rect.Dy() <= minHeight {
+		return img
+	}
+
+	return cropImage(img, rect)
+}
+
+// cropImage copies the part of the image, so it starts at zero like hashes expect
+func cropImage(img image.Image, rect image.Rectangle) *image.RGBA {
+	cropped := image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	draw.Draw(cropped, cropped.Bounds(), img, rect.Min, draw.Src)
+	return cropped
+}
+
+// centerCrop returns the middle of the image with the share of its sides in percents
+func centerCrop(img image.Image, share int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx()*share/100, bounds.Dy()*share/100
+	corner := bounds.Min.Add(image.Pt((bounds.Dx()-width)/2, (bounds.Dy()-height)/2))
+	return cropImage(img, image.Rectangle{Min: corner, Max: corner.Add(image.Pt(width, height))})
+}
+
+// cropHashes returns pHashes of the center crops of the image
+func cropHashes(img image.Image) ([]uint64, error) {
+	crops := make([]uint64, len(cropShares))
+	for i, share := range cropShares {
+		hash, err := goimagehash.PerceptionHash(centerCrop(img, share))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get perception hash of crop")
+		}
+		crops[i] = hash.GetHash()
+	}
+	return crops, nil
+}
+
+// findCropped finds pictures that are crops of the picture or have it among their crops.
+// They are compared by the pHash alone, crops have no dHash.
+func (b *BayanBot) findCropped(chatID int64, kind storage.MediaKind, pHash uint64, crops []uint64, threshold int) ([]*match, error) {
+	found, err := b.store.FindPicturesNear(chatID, kind, storage.HashCrop, pHash, searchThreshold(threshold), 0)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, crop := range crops {
+		cropFound, err := b.store.FindPicturesNear(chatID, kind, storage.HashPerception, crop, searchThreshold(threshold), 0)
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, cropFound...)
+	}
+
+	return detectedBy(matched(found...), kind, storage.AlgorithmCrop, threshold), nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// borderedImage is a checkered picture in content surrounded by a bar color
+func borderedImage(width, height int, bar color.RGBA, content image.Rectangle) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := bar
+			if (image.Point{X: x, Y: y}).In(content) {
+				c = color.RGBA{R: 0xff, A: 0xff}
+				if (x/2+y/2)%2 == 0 {
+					c = color.RGBA{B: 0xff, A: 0xff}
+				}
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestTrimBorders(t *testing.T) {
+	black := color.RGBA{A: 0xff}
+	white := color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+
+	tests := []struct {
+		name    string
+		img     *image.RGBA
+		want    image.Point
+		trimmed bool
+	}{
+		{"letterbox", borderedImage(100, 100, black, image.Rect(0, 20, 100, 80)), image.Pt(100, 60), true},
+		{"padding", borderedImage(100, 100, white, image.Rect(10, 15, 90, 85)), image.Pt(80, 70), true},
+		{"no border", borderedImage(100, 100, white, image.Rect(0, 0, 100, 100)), image.Pt(100, 100), false},
+		{"near the minimum share", borderedImage(100, 100, white, image.Rect(35, 35, 65, 65)), image.Pt(30, 30), true},
+		{"mostly one color", borderedImage(100, 100, white, image.Rect(45, 45, 55, 55)), image.Pt(100, 100), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := trimBorders(tt.img)
+			if got.Bounds().Size() != tt.want {
+				t.Errorf("got size %v, want %v", got.Bounds().Size(), tt.want)
+			}
+			if trimmed := got != image.Image(tt.img); trimmed != tt.trimmed {
+				t.Errorf("got trimmed %v, want %v", trimmed, tt.trimmed)
+			}
+		})
+	}
+}
+
+func TestTrimNoisyBorders(t *testing.T) {
+	img := borderedImage(100, 100, color.RGBA{A: 0xff}, image.Rect(0, 20, 100, 80))
+	// JPEG artifacts make bars a bit lighter here and there
+	for x := 0; x < 100; x += 7 {
+		img.SetRGBA(x, 5, color.RGBA{R: 0x10, G: 0x10, B: 0x10, A: 0xff})
+		img.SetRGBA(x, 90, color.RGBA{R: 0x08, G: 0x0c, B: 0x10, A: 0xff})
+	}
+
+	got := trimBorders(img)
+	if got.Bounds().Size() != image.Pt(100, 60) {
+		t.Errorf("got size %v, want %v", got.Bounds().Size(), image.Pt(100, 60))
+	}
+}
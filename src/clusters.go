@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"github.com/go-telegram/bot/models"
+	"github.com/sleroq/bayan/src/storage"
+	"go.uber.org/zap"
+	"strings"
+)
+
+const (
+	// clusterNoteSize is how many copies a meme needs to have its count in the reply
+	clusterNoteSize = 3
+	// maxClusterPosters is how many previous posters are named in the reply
+	maxClusterPosters = 5
+	// maxClusterLinks is how many copies /compare lists
+	maxClusterLinks = 20
+)
+
+// joinCluster adds the message to the cluster of its matches and returns the cluster.
+// Errors are only logged, a reply is still useful without the count.
+func (b *BayanBot) joinCluster(msg *models.Message, similar []*match) *storage.Cluster {
+	messages := make([]*storage.Message, len(similar))
+	for i, s := range similar {
+		messages[i] = s.Msg
+	}
+
+	err := b.store.JoinCluster(msg, messages)
+	if err != nil {
+		b.logger.Error("failed to join cluster", zap.Error(err))
+		return nil
+	}
+
+	return b.getCluster(msg.Chat.ID, msg.ID)
+}
+
+// getCluster returns the cluster of the message or nil, errors are only logged
+func (b *BayanBot) getCluster(chatID int64, id int) *storage.Cluster {
+	cluster, err := b.store.GetCluster(chatID, id)
+	if err != nil {
+		b.logger.Error("failed to get cluster", zap.Error(err))
+		return nil
+	}
+
+	return cluster
+}
+
+// escapeMarkdown escapes user names for the legacy markdown parse mode
+func escapeMarkdown(text string) string {
+	return strings.NewReplacer("_", "\\_", "*", "\\*", "`", "\\`", "[", "\\[").Replace(text)
+}
+
+// clusterCount formats how many times the meme was posted, counting the message itself
+func clusterCount(cluster *storage.Cluster) string {
+	if cluster == nil || len(cluster.Members) < clusterNoteSize {
+		return ""
+	}
+
+	return fmt.Sprintf(" (%d-й раз)", len(cluster.Members))
+}
+
+// clusterPosters formats names of those who posted the meme before the message
+func clusterPosters(cluster *storage.Cluster, id int) string {
+	if cluster == nil || len(cluster.Members) < clusterNoteSize {
+		return ""
+	}
+
+	var names []string
+	seen := make(map[string]bool)
+	for _, member := range cluster.Members {
+		if member.Msg.ID == id || member.UserName == "" || seen[member.UserName] {
+			continue
+		}
+		seen[member.UserName] = true
+		names = append(names, escapeMarkdown(member.UserName))
+	}
+
+	if len(names) == 0 {
+		return ""
+	}
+
+	text := "Уже постили: " + strings.Join(names[:min(len(names), maxClusterPosters)], ", ")
+	if len(names) > maxClusterPosters {
+		text += fmt.Sprintf(" и ещё %d", len(names)-maxClusterPosters)
+	}
+
+	return text + "\n"
+}
+
+// clusterLinks lists every copy of the meme for /compare, the original first
+func clusterLinks(cluster *storage.Cluster) string {
+	if cluster == nil {
+		return ""
+	}
+
+	text := fmt.Sprintf("\nВсе копии (%d):\n", len(cluster.Members))
+	for i, member := range cluster.Members[:min(len(cluster.Members), maxClusterLinks)] {
+		text += "- " + messageLink(member.Msg)
+		if member.UserName != "" {
+			text += " от " + member.UserName
+		}
+		if i == 0 {
+			text += " (оригинал)"
+		}
+		text += "\n"
+	}
+
+	if len(cluster.Members) > maxClusterLinks {
+		text += fmt.Sprintf("и ещё %d\n", len(cluster.Members)-maxClusterLinks)
+	}
+
+	return text
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// confidence is how sure the bot is that a message is a repost
+type confidence string
+
+const (
+	// confidenceExact is the same file or nearly the same hashes
+	confidenceExact confidence = "exact"
+	// confidenceLikely is under the threshold of the chat
+	confidenceLikely confidence = "likely"
+	// confidencePossible is a bit over the threshold, admins decide if it's a repost
+	confidencePossible confidence = "possible"
+	// confidenceNone is too far to be a repost
+	confidenceNone confidence = "none"
+)
+
+// Scores are from 0 to maxScore. A message at the threshold of the chat scores likelyScore,
+// and the search for possible matches ends at possibleScore, half the threshold further.
+const (
+	maxScore      = 100
+	exactScore    = 90
+	likelyScore   = 50
+	possibleScore = 25
+)
+
+// Weights of hashes in the fused score, the pHash is more reliable than the dHash.
+// The average hash is not fused: it's a coarser look at the same brightness the other two
+// already compare, goimagehash has no wavelet hash, and saved pictures have neither.
+const (
+	pHashWeight = 2
+	dHashWeight = 1
+)
+
+func confidenceOf(score int) confidence {
+	switch {
+	case score >= exactScore:
+		return confidenceExact
+	case score > likelyScore:
+		return confidenceLikely
+	case score > possibleScore:
+		return confidencePossible
+	default:
+		return confidenceNone
+	}
+}
+
+// ratioScore turns a distance relative to the threshold into a score
+func ratioScore(ratio float64) int {
+	score := maxScore - int(math.Floor(ratio*(maxScore-likelyScore)))
+	return max(0, min(maxScore, score))
+}
+
+// distanceScore scores a match found by one hash. Exact algorithms have no threshold and score maxScore.
+func distanceScore(distance, threshold int) int {
+	if threshold == 0 {
+		return maxScore
+	}
+	return ratioScore(float64(distance) / float64(threshold))
+}
+
+// fusedScore scores a match by both of its hashes, each relative to its own threshold
+func fusedScore(pDistance, pThreshold, dDistance, dThreshold int) int {
+	ratio := (pHashWeight*float64(pDistance)/float64(pThreshold) + dHashWeight*float64(dDistance)/float64(dThreshold)) /
+		(pHashWeight + dHashWeight)
+	return ratioScore(ratio)
+}
+
+// fuseDifference rescores messages found by the pHash with their dHash distance and sorts them
+// the most likely first. Messages the dHash search missed are scored as if they were at its limit.
+func fuseDifference(found, dFound []*match, threshold int) {
+	dDistances := make(map[int]int, len(dFound))
+	for _, s := range dFound {
+		dDistances[s.Msg.ID] = s.Distance
+	}
+
+	dThreshold := compareThreshold(threshold)
+	for _, s := range found {
+		dDistance, ok := dDistances[s.Msg.ID]
+		if !ok {
+			dDistance = searchThreshold(dThreshold)
+		}
+		s.score = fusedScore(s.Distance, threshold, dDistance, dThreshold)
+	}
+
+	sortByScore(found)
+}
+
+// sortByScore sorts messages the most likely first, then like sortSimilar
+func sortByScore(similar []*match) {
+	sortSimilar(similar)
+	sort.SliceStable(similar, func(i, j int) bool {
+		return similar[i].score > similar[j].score
+	})
+}
+
+// bestMatches keeps the best scored match of every message found several ways, the most likely first
+func bestMatches(similar []*match) []*match {
+	sortByScore(similar)
+
+	seen := make(map[int]bool)
+	best := similar[:0]
+	for _, s := range similar {
+		if seen[s.Msg.ID] {
+			continue
+		}
+		seen[s.Msg.ID] = true
+		best = append(best, s)
+	}
+
+	return best
+}
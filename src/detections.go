@@ -0,0 +1,114 @@
+package main
+
+import (
+	"github.com/go-telegram/bot/models"
+	"github.com/sleroq/bayan/src/storage"
+	"go.uber.org/zap"
+	"sort"
+)
+
+// match is a message found similar to a new one, with how it was found
+type match struct {
+	*storage.SimilarMessage
+	// kind, algorithm and threshold describe the comparison the message was found by, they are saved with detections
+	kind      storage.MediaKind
+	algorithm storage.Algorithm
+	threshold int
+	// score is from 0 to 100, how sure the bot is that the message is a copy
+	score int
+	// transform is how the new picture was flipped or rotated to match, empty if it wasn't
+	transform transform
+	// part is the part of the matched video the new one covers, nil if it covers all of it
+	part *storage.VideoPart
+}
+
+// matched wraps messages found by the storage
+func matched(similar ...*storage.SimilarMessage) []*match {
+	matches := make([]*match, len(similar))
+	for i, s := range similar {
+		matches[i] = &match{SimilarMessage: s}
+	}
+	return matches
+}
+
+// matchedVideos wraps videos found by the storage with the parts they matched
+func matchedVideos(similar []*storage.SimilarVideo) []*match {
+	matches := make([]*match, len(similar))
+	for i, s := range similar {
+		matches[i] = &match{SimilarMessage: &s.SimilarMessage, part: s.Part}
+	}
+	return matches
+}
+
+// sortSimilar sorts matches like storage.SortSimilar
+func sortSimilar(similar []*match) {
+	sort.SliceStable(similar, func(i, j int) bool {
+		return similar[i].Closer(similar[j].SimilarMessage)
+	})
+}
+
+// detectedBy marks how the messages were found and scores them by distance, it's saved with detections
+func detectedBy(similar []*match, kind storage.MediaKind, algorithm storage.Algorithm, threshold int) []*match {
+	for _, s := range similar {
+		s.kind = kind
+		s.algorithm = algorithm
+		s.threshold = threshold
+		s.score = distanceScore(s.Distance, threshold)
+	}
+	return similar
+}
+
+// searchThreshold widens the threshold by half, so possible matches are found too
+func searchThreshold(threshold int) int {
+	return threshold + threshold/2
+}
+
+// splitByConfidence returns exact and likely matches. If there are none, possible matches
+// are queued for review by chat admins. With near misses recorded, all other matches are saved as near misses.
+func (b *BayanBot) splitByConfidence(msg *models.Message, found []*match) []*match {
+	var similar, possible, nearMisses []*match
+	for _, s := range found {
+		switch confidenceOf(s.score) {
+		case confidenceExact, confidenceLikely:
+			similar = append(similar, s)
+		case confidencePossible:
+			possible = append(possible, s)
+			nearMisses = append(nearMisses, s)
+		default:
+			nearMisses = append(nearMisses, s)
+		}
+	}
+
+	if len(similar) == 0 {
+		for _, s := range possible {
+			err := b.store.SaveReview(msg, s.Msg, s.kind, s.algorithm, s.Distance, s.threshold, s.score)
+			if err != nil {
+				b.logger.Error("failed to queue review", zap.Error(err))
+			}
+		}
+	}
+
+	if b.nearMisses {
+		b.saveDetections(msg, nearMisses, true)
+	}
+
+	return similar
+}
+
+// saveDetections saves comparisons of the message with the matches, errors are only logged
+func (b *BayanBot) saveDetections(msg *models.Message, similar []*match, nearMiss bool) {
+	for _, s := range similar {
+		err := b.store.SaveDetection(msg, s.Msg, s.kind, s.algorithm, s.Distance, s.threshold, nearMiss)
+		if err != nil {
+			b.logger.Error("failed to save detection", zap.Error(err))
+		}
+	}
+}
+
+// recordRepost saves detections of the repost and adds it to the cluster of its matches.
+// Errors are only logged, the reply is sent anyway.
+func (b *BayanBot) recordRepost(msg *models.Message, similar []*match) *storage.Cluster {
+	b.saveDetections(msg, similar, false)
+
+	return b.joinCluster(msg, similar)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-faster/errors"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"github.com/sleroq/bayan/src/storage"
+	"time"
+)
+
+// forwardOrigin returns nil for messages that are not forwards.
+// Only channel posts have message ids, other origins are told apart by the sender and the date.
+func forwardOrigin(msg *models.Message) *storage.ForwardOrigin {
+	origin := msg.ForwardOrigin
+	if origin == nil {
+		return nil
+	}
+
+	switch {
+	case origin.MessageOriginChannel != nil:
+		o := origin.MessageOriginChannel
+		return &storage.ForwardOrigin{
+			Key:  fmt.Sprintf("channel:%d/%d", o.Chat.ID, o.MessageID),
+			Date: time.Unix(int64(o.Date), 0),
+		}
+	case origin.MessageOriginChat != nil:
+		o := origin.MessageOriginChat
+		return &storage.ForwardOrigin{
+			Key:  fmt.Sprintf("chat:%d@%d", o.SenderChat.ID, o.Date),
+			Date: time.Unix(int64(o.Date), 0),
+		}
+	case origin.MessageOriginUser != nil:
+		o := origin.MessageOriginUser
+		return &storage.ForwardOrigin{
+			Key:  fmt.Sprintf("user:%d@%d", o.SenderUser.ID, o.Date),
+			Date: time.Unix(int64(o.Date), 0),
+		}
+	case origin.MessageOriginHiddenUser != nil:
+		o := origin.MessageOriginHiddenUser
+		return &storage.ForwardOrigin{
+			Key:  fmt.Sprintf("hidden_user:%s@%d", o.SenderUserName, o.Date),
+			Date: time.Unix(int64(o.Date), 0),
+		}
+	default:
+		return nil
+	}
+}
+
+// processForward replies if the same original message was already forwarded to the chat.
+// Works for any message, even without media. Returns true if the message is a re-forward,
+// so its media is not reported again.
+func (b *BayanBot) processForward(ctx context.Context, api *bot.Bot, msg *models.Message) (bool, error) {
+	origin := forwardOrigin(msg)
+	if origin == nil {
+		return false, nil
+	}
+
+	similar, err := b.store.FindForward(msg.Chat.ID, origin.Key)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to find forward")
+	}
+
+	err = b.store.SaveForward(msg, origin)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to save forward")
+	}
+
+	// Albums get one reply for all items
+	if similar == nil || msg.MediaGroupID != "" {
+		return false, nil
+	}
+
+	similar, err = b.firstSeen(msg.Chat.ID, similar, origin.Date)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to find first seen original")
+	}
+
+	err = b.replyBayan(ctx, api, msg, &match{SimilarMessage: similar, algorithm: storage.AlgorithmForward, score: maxScore})
+	if err != nil {
+		return false, errors.Wrap(err, "failed to reply bayan")
+	}
+
+	return true, nil
+}
+
+// firstSeen picks the original of a re-forward. It's the first forward, unless the media of it
+// was posted to the chat before the original post was made, then it's the first copy of the media.
+func (b *BayanBot) firstSeen(chatID int64, forward *storage.SimilarMessage, originDate time.Time) (*storage.SimilarMessage, error) {
+	cluster, err := b.store.GetCluster(chatID, forward.Msg.ID)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get cluster")
+	}
+
+	if cluster == nil || !cluster.Original().Msg.SentDate.Before(originDate) {
+		return forward, nil
+	}
+
+	return &storage.SimilarMessage{Msg: cluster.Original().Msg, Distance: 0}, nil
+}
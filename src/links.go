@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"github.com/go-faster/errors"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"github.com/sleroq/bayan/src/links"
+	"github.com/sleroq/bayan/src/storage"
+	"unicode/utf16"
+)
+
+// entityText returns the text covered by the entity. Entity offsets are in UTF-16 code units.
+func entityText(text []uint16, entity models.MessageEntity) string {
+	if entity.Offset < 0 || entity.Length < 0 || entity.Offset+entity.Length > len(text) {
+		return ""
+	}
+
+	return string(utf16.Decode(text[entity.Offset : entity.Offset+entity.Length]))
+}
+
+// entityURLs returns both plain urls and urls hidden behind text
+func entityURLs(text string, entities []models.MessageEntity) []string {
+	encoded := utf16.Encode([]rune(text))
+
+	var urls []string
+	for _, entity := range entities {
+		switch entity.Type {
+		case models.MessageEntityTypeURL:
+			urls = append(urls, entityText(encoded, entity))
+		case models.MessageEntityTypeTextLink:
+			urls = append(urls, entity.URL)
+		}
+	}
+
+	return urls
+}
+
+// canonicalLinks returns unique canonical links from the text and the caption of the message
+func canonicalLinks(msg *models.Message) []string {
+	urls := entityURLs(msg.Text, msg.Entities)
+	urls = append(urls, entityURLs(msg.Caption, msg.CaptionEntities)...)
+
+	seen := make(map[string]bool)
+	var canonical []string
+	for _, u := range urls {
+		link, ok := links.Canonicalize(u)
+		if !ok || seen[link] {
+			continue
+		}
+
+		seen[link] = true
+		canonical = append(canonical, link)
+	}
+
+	return canonical
+}
+
+// findLinks finds the first message that shared the same content. Returns nil save func for messages without links.
+func (b *BayanBot) findLinks(msg *models.Message) (similar []*match, save func() error, err error) {
+	canonical := canonicalLinks(msg)
+	if len(canonical) == 0 {
+		return nil, nil, nil
+	}
+
+	save = func() error {
+		err := b.store.SaveLinks(msg, canonical)
+		if err != nil {
+			return errors.Wrap(err, "failed to save links")
+		}
+
+		return nil
+	}
+
+	for _, link := range canonical {
+		found, err := b.store.FindLink(msg.Chat.ID, link)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to find link")
+		}
+
+		if found != nil {
+			return []*match{{SimilarMessage: found, algorithm: storage.AlgorithmLink, score: maxScore}}, save, nil
+		}
+	}
+
+	return nil, save, nil
+}
+
+// processLinks replies with the first message that shared the same content
+func (b *BayanBot) processLinks(ctx context.Context, api *bot.Bot, msg *models.Message) error {
+	similar, save, err := b.findLinks(msg)
+	if err != nil || save == nil {
+		return err
+	}
+
+	err = save()
+	if err != nil {
+		return err
+	}
+
+	if len(similar) > 0 {
+		err = b.replyBayan(ctx, api, msg, similar...)
+		if err != nil {
+			return errors.Wrap(err, "failed to reply bayan")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,198 @@
+// Package links turns different urls pointing to the same content into one canonical form.
+package links
+
+import (
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// trackingParams are removed from every url, they don't change the content
+var trackingParams = map[string]bool{
+	"fbclid":  true,
+	"gclid":   true,
+	"yclid":   true,
+	"dclid":   true,
+	"mc_cid":  true,
+	"mc_eid":  true,
+	"igshid":  true,
+	"igsh":    true,
+	"si":      true,
+	"feature": true,
+	"ref":     true,
+	"ref_src": true,
+	"ref_url": true,
+	"spm":     true,
+	"_hsenc":  true,
+	"_hsmi":   true,
+	"share":   true,
+}
+
+// trackingPrefixes are removed like trackingParams, but match by prefix
+var trackingPrefixes = []string{"utm_", "share_", "is_from_"}
+
+// hostPrefixes don't change the content, m.youtube.com is the same as youtube.com
+var hostPrefixes = []string{"www.", "m.", "mobile."}
+
+var (
+	youtubeID   = regexp.MustCompile(`^[\w-]{11}$`)
+	numericID   = regexp.MustCompile(`^\d+$`)
+	redditID    = regexp.MustCompile(`^[a-z0-9]+$`)
+	instagramID = regexp.MustCompile(`^[\w-]+$`)
+	shortCode   = regexp.MustCompile(`^[\w-]+$`)
+)
+
+// Canonicalize returns the canonical form of the url and false if it's not a web link.
+// Links to known platforms become platform content ids like "youtube:dQw4w9WgXcQ",
+// everything else becomes host and path without tracking parameters.
+func Canonicalize(raw string) (string, bool) {
+	raw = strings.TrimSpace(raw)
+	if !strings.Contains(raw, "://") {
+		raw = "https://" + raw
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", false
+	}
+
+	// Schemes like mailto: are parsed as user info after adding https://
+	if u.Scheme != "http" && u.Scheme != "https" || u.User != nil {
+		return "", false
+	}
+
+	host := strings.ToLower(u.Hostname())
+	for _, prefix := range hostPrefixes {
+		host = strings.TrimPrefix(host, prefix)
+	}
+	if !strings.Contains(host, ".") {
+		return "", false
+	}
+
+	segments := splitPath(u.Path)
+	query := u.Query()
+
+	if id, ok := platformID(host, segments, query); ok {
+		return id, true
+	}
+
+	for key := range query {
+		if isTrackingParam(key) {
+			query.Del(key)
+		}
+	}
+
+	canonical := host + "/" + strings.Join(segments, "/")
+	if len(query) > 0 {
+		keys := make([]string, 0, len(query))
+		for key := range query {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		params := make([]string, 0, len(keys))
+		for _, key := range keys {
+			values := query[key]
+			sort.Strings(values)
+			for _, value := range values {
+				params = append(params, url.QueryEscape(key)+"="+url.QueryEscape(value))
+			}
+		}
+		canonical += "?" + strings.Join(params, "&")
+	}
+
+	return canonical, true
+}
+
+func splitPath(p string) []string {
+	p = path.Clean("/" + p)
+	var segments []string
+	for _, s := range strings.Split(p, "/") {
+		if s != "" {
+			segments = append(segments, s)
+		}
+	}
+	return segments
+}
+
+func isTrackingParam(key string) bool {
+	key = strings.ToLower(key)
+	if trackingParams[key] {
+		return true
+	}
+
+	for _, prefix := range trackingPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// platformID extracts content ids from links to platforms people share memes from.
+// Short links are resolved only when the id is in the link itself, nothing is fetched.
+func platformID(host string, segments []string, query url.Values) (string, bool) {
+	switch host {
+	case "youtube.com", "music.youtube.com", "youtube-nocookie.com":
+		if len(segments) == 1 && segments[0] == "watch" && youtubeID.MatchString(query.Get("v")) {
+			return "youtube:" + query.Get("v"), true
+		}
+		if len(segments) >= 2 && youtubeID.MatchString(segments[1]) {
+			switch segments[0] {
+			case "shorts", "embed", "live", "v", "e":
+				return "youtube:" + segments[1], true
+			}
+		}
+	case "youtu.be":
+		if len(segments) >= 1 && youtubeID.MatchString(segments[0]) {
+			return "youtube:" + segments[0], true
+		}
+	case "tiktok.com":
+		// tiktok.com/@user/video/7234567890123456789
+		for i := 0; i+1 < len(segments); i++ {
+			if (segments[i] == "video" || segments[i] == "photo") && numericID.MatchString(segments[i+1]) {
+				return "tiktok:" + segments[i+1], true
+			}
+		}
+		// tiktok.com/t/ZTRxxxxxx is a short link, the video id can't be derived from it
+		if len(segments) == 2 && segments[0] == "t" && shortCode.MatchString(segments[1]) {
+			return "tiktok-short:" + segments[1], true
+		}
+	case "vm.tiktok.com", "vt.tiktok.com":
+		if len(segments) >= 1 && shortCode.MatchString(segments[0]) {
+			return "tiktok-short:" + segments[0], true
+		}
+	case "reddit.com", "old.reddit.com", "new.reddit.com":
+		// reddit.com/r/sub/comments/abc123/title
+		for i := 0; i+1 < len(segments); i++ {
+			if segments[i] == "comments" && redditID.MatchString(segments[i+1]) {
+				return "reddit:" + segments[i+1], true
+			}
+		}
+	case "redd.it":
+		if len(segments) == 1 && redditID.MatchString(segments[0]) {
+			return "reddit:" + segments[0], true
+		}
+	case "twitter.com", "x.com", "fxtwitter.com", "vxtwitter.com", "fixupx.com", "fixvx.com", "nitter.net":
+		// x.com/user/status/1234567890
+		for i := 0; i+1 < len(segments); i++ {
+			if segments[i] == "status" && numericID.MatchString(segments[i+1]) {
+				return "twitter:" + segments[i+1], true
+			}
+		}
+	case "instagram.com", "ddinstagram.com":
+		for i := 0; i+1 < len(segments); i++ {
+			switch segments[i] {
+			case "p", "reel", "reels", "tv":
+				if instagramID.MatchString(segments[i+1]) {
+					return "instagram:" + segments[i+1], true
+				}
+			}
+		}
+	}
+
+	return "", false
+}
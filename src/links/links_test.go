@@ -0,0 +1,43 @@
+package links
+
+import "testing"
+
+func TestCanonicalize(t *testing.T) {
+	tests := []struct {
+		raw    string
+		want   string
+		wantOk bool
+	}{
+		{"https://www.youtube.com/watch?v=dQw4w9WgXcQ&t=42s", "youtube:dQw4w9WgXcQ", true},
+		{"https://m.youtube.com/watch?v=dQw4w9WgXcQ&feature=share", "youtube:dQw4w9WgXcQ", true},
+		{"https://youtu.be/dQw4w9WgXcQ?si=AbCdEfGhIjKlMnOp", "youtube:dQw4w9WgXcQ", true},
+		{"https://youtube.com/shorts/dQw4w9WgXcQ?si=AbCdEfGhIjKlMnOp", "youtube:dQw4w9WgXcQ", true},
+		{"https://music.youtube.com/watch?v=dQw4w9WgXcQ", "youtube:dQw4w9WgXcQ", true},
+		{"youtube.com/embed/dQw4w9WgXcQ", "youtube:dQw4w9WgXcQ", true},
+		{"https://www.tiktok.com/@user/video/7234567890123456789?is_from_webapp=1", "tiktok:7234567890123456789", true},
+		{"https://vm.tiktok.com/ZMabc123/", "tiktok-short:ZMabc123", true},
+		{"https://www.tiktok.com/t/ZTRabc123/", "tiktok-short:ZTRabc123", true},
+		{"https://www.instagram.com/reel/CxYz_123-ab/?igsh=abc", "instagram:CxYz_123-ab", true},
+		{"https://instagram.com/p/CxYz_123-ab", "instagram:CxYz_123-ab", true},
+		{"https://x.com/user/status/1234567890?s=20", "twitter:1234567890", true},
+		{"https://mobile.twitter.com/user/status/1234567890", "twitter:1234567890", true},
+		{"https://fxtwitter.com/user/status/1234567890", "twitter:1234567890", true},
+		{"https://old.reddit.com/r/memes/comments/abc123/some_title/", "reddit:abc123", true},
+		{"https://redd.it/abc123", "reddit:abc123", true},
+		{"https://Example.com/a/../b/?utm_source=tg&utm_medium=social&b=2&a=1", "example.com/b?a=1&b=2", true},
+		{"http://www.example.com/page?fbclid=abc", "example.com/page", true},
+		{"https://youtube.com/channel/UC123", "youtube.com/channel/UC123", true},
+		{"mailto:user@example.com", "", false},
+		{"ftp://example.com/file", "", false},
+		{"localhost/page", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			got, ok := Canonicalize(tt.raw)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("got %q, %v, want %q, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
@@ -2,46 +2,82 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
 	"fmt"
 	"github.com/Netflix/go-env"
 	"github.com/corona10/goimagehash"
 	"github.com/go-faster/errors"
 	"github.com/go-telegram/bot"
 	"github.com/go-telegram/bot/models"
+	"github.com/sleroq/bayan/src/audio"
 	"github.com/sleroq/bayan/src/storage"
 	"go.uber.org/zap"
-	"image/jpeg"
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/webp"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
 	"io"
 	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
-	"os/exec"
 	"os/signal"
 	"regexp"
+	"strings"
 	"time"
 )
 
+// maxDownloadSize is the biggest file telegram bot api allows to download
+const maxDownloadSize = 20 * 1024 * 1024
+
 type BayanBot struct {
-	token          string
-	logger         *zap.Logger
-	store          *storage.Storage
-	kekReplyChance float64
-	showSimilarity bool
+	token           string
+	logger          *zap.Logger
+	store           storage.Store
+	kekReplyChance  float64
+	showSimilarity  bool
+	stickersEnabled bool
+	textMinLength   int
+	replyMatch      replyMatch
+	nearMisses      bool
+	// thresholds are the defaults for chats that didn't change them
+	thresholds map[thresholdMedia]int
+	// sceneSensitivity is the score ffmpeg needs to take a frame as a scene change
+	sceneSensitivity float64
+	albums           *albumBuffer
 }
 
 type BayanConfig struct {
-	kekReplyChance float64 `env:"KEK_REPLY_CHANCE"`
-	showSimilarity bool    `env:"SHOW_SIMILARITY"`
+	kekReplyChance   float64 `env:"KEK_REPLY_CHANCE"`
+	showSimilarity   bool    `env:"SHOW_SIMILARITY"`
+	stickersEnabled  bool    `env:"STICKERS_ENABLED"`
+	textMinLength    int     `env:"TEXT_MIN_LENGTH"`
+	replyMatch       replyMatch
+	nearMisses       bool
+	thresholds       map[thresholdMedia]int
+	sceneSensitivity float64
 }
 
-func NewBayanBot(token string, store *storage.Storage, logger *zap.Logger, cfg BayanConfig) *BayanBot {
+func NewBayanBot(token string, store storage.Store, logger *zap.Logger, cfg BayanConfig) *BayanBot {
 	return &BayanBot{
-		token:          token,
-		logger:         logger,
-		store:          store,
-		kekReplyChance: cfg.kekReplyChance,
-		showSimilarity: cfg.showSimilarity,
+		token:            token,
+		logger:           logger,
+		store:            store,
+		kekReplyChance:   cfg.kekReplyChance,
+		showSimilarity:   cfg.showSimilarity,
+		stickersEnabled:  cfg.stickersEnabled,
+		textMinLength:    cfg.textMinLength,
+		replyMatch:       cfg.replyMatch,
+		nearMisses:       cfg.nearMisses,
+		thresholds:       cfg.thresholds,
+		sceneSensitivity: cfg.sceneSensitivity,
+		albums:           &albumBuffer{albums: make(map[string]*album)},
 	}
 }
 
@@ -60,17 +96,80 @@ func (b *BayanBot) processMessage(ctx context.Context, api *bot.Bot, update *mod
 		return
 	}
 
+	reforward, err := b.processForward(ctx, api, update.Message)
+	if err != nil {
+		b.logger.Error("failed to process forward", zap.Error(err))
+	}
+
+	if reforward {
+		return
+	}
+
+	// Items of an album are checked together, when the whole album arrives
+	if update.Message.MediaGroupID != "" {
+		b.bufferAlbumItem(ctx, api, update.Message)
+		return
+	}
+
+	err = b.processLinks(ctx, api, update.Message)
+	if err != nil {
+		b.logger.Error("failed to process links", zap.Error(err))
+	}
+
 	if update.Message.Photo != nil {
-		err := b.processPicture(ctx, api, update.Message, update.Message.Photo[0])
+		err := b.processPicture(ctx, api, update.Message, pictureFromPhoto(update.Message.Photo[0]))
 		if err != nil {
-			b.logger.Error("failed to process pictures", zap.Error(err))
+			b.logMediaError("failed to process pictures", err)
 		}
 	}
 
 	if update.Message.Video != nil {
-		err := b.processVideo(ctx, api, update.Message)
+		err := b.processVideo(ctx, api, update.Message, videoFromVideo(update.Message.Video))
 		if err != nil {
-			b.logger.Error("failed to process video", zap.Error(err))
+			b.logMediaError("failed to process video", err)
+		}
+	}
+
+	if update.Message.Animation != nil {
+		err := b.processVideo(ctx, api, update.Message, videoFromAnimation(update.Message.Animation))
+		if err != nil {
+			b.logMediaError("failed to process animation", err)
+		}
+	}
+
+	if update.Message.VideoNote != nil {
+		err := b.processVideo(ctx, api, update.Message, videoFromVideoNote(update.Message.VideoNote))
+		if err != nil {
+			b.logMediaError("failed to process video note", err)
+		}
+	}
+
+	if update.Message.Voice != nil {
+		err := b.processAudio(ctx, api, update.Message, audioFromVoice(update.Message.Voice))
+		if err != nil {
+			b.logMediaError("failed to process voice", err)
+		}
+	}
+
+	if update.Message.Audio != nil {
+		err := b.processAudio(ctx, api, update.Message, audioFromAudio(update.Message.Audio))
+		if err != nil {
+			b.logMediaError("failed to process audio", err)
+		}
+	}
+
+	if update.Message.Sticker != nil {
+		err := b.processSticker(ctx, api, update.Message, update.Message.Sticker)
+		if err != nil {
+			b.logMediaError("failed to process sticker", err)
+		}
+	}
+
+	// Animations also come with the document field set
+	if update.Message.Document != nil && update.Message.Animation == nil {
+		err := b.processDocument(ctx, api, update.Message, update.Message.Document)
+		if err != nil {
+			b.logMediaError("failed to process document", err)
 		}
 	}
 
@@ -78,6 +177,13 @@ func (b *BayanBot) processMessage(ctx context.Context, api *bot.Bot, update *mod
 		// TODO: Add story processing when telegram bot api will support it
 	}
 
+	if b.isLongText(messageText(update.Message)) {
+		err := b.processText(ctx, api, update.Message)
+		if err != nil {
+			b.logger.Error("failed to process text", zap.Error(err))
+		}
+	}
+
 	if update.Message.Text != "" {
 		matchBayan, err := regexp.MatchString(`(?i)баян`, update.Message.Text)
 		if err != nil {
@@ -127,94 +233,378 @@ func (b *BayanBot) downloadFile(ctx context.Context, api *bot.Bot, fileID string
 	return file.Body, nil
 }
 
-func (b *BayanBot) hashPicture(ctx context.Context, api *bot.Bot, pic models.PhotoSize) (pHash, dHash *goimagehash.ImageHash, err error) {
+// pictureFile is the part of photos and image documents needed to fingerprint them.
+type pictureFile struct {
+	FileID   string
+	MimeType string
+	Media    storage.Media
+}
+
+// pictureFromPhoto works for thumbnails too, telegram always sends them as jpeg
+func pictureFromPhoto(photo models.PhotoSize) *pictureFile {
+	return &pictureFile{
+		FileID:   photo.FileID,
+		MimeType: "image/jpeg",
+		Media:    storage.Media{FileUniqueID: photo.FileUniqueID},
+	}
+}
+
+// unsupportedFormatError is returned when none of the registered decoders
+// understand the picture. It is not a failure, such pictures are just skipped.
+type unsupportedFormatError struct {
+	mimeType string
+}
+
+func (e *unsupportedFormatError) Error() string {
+	if e.mimeType == "" {
+		return "unsupported image format"
+	}
+	return fmt.Sprintf("unsupported image format %q", e.mimeType)
+}
+
+// decodeImage detects the format by the content, mime type is only used for errors.
+// Supports jpeg, png, webp, bmp and gif (first frame only).
+func decodeImage(r io.Reader, mimeType string) (image.Image, error) {
+	img, _, err := image.Decode(r)
+	if errors.Is(err, image.ErrFormat) {
+		return nil, &unsupportedFormatError{mimeType: mimeType}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return img, nil
+}
+
+// flattenAlpha puts transparent pictures (stickers, png documents) on a white
+// background, otherwise hashes depend on the color hidden under transparent pixels
+func flattenAlpha(img image.Image) image.Image {
+	if opaque, ok := img.(interface{ Opaque() bool }); ok && opaque.Opaque() {
+		return img
+	}
+
+	flat := image.NewRGBA(img.Bounds())
+	draw.Draw(flat, flat.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), img, img.Bounds().Min, draw.Over)
+
+	return flat
+}
+
+// logMediaError logs unsupported formats as skips and everything else as failures
+func (b *BayanBot) logMediaError(msg string, err error) {
+	var formatErr *unsupportedFormatError
+	if errors.As(err, &formatErr) {
+		b.logger.Debug("skipping media in unsupported format", zap.String("mime_type", formatErr.mimeType))
+		return
+	}
+
+	b.logger.Error(msg, zap.Error(err))
+}
+
+// pictureHashes are hashes of a picture without borders
+type pictureHashes struct {
+	pHash, dHash *goimagehash.ImageHash
+	// crops are pHashes of center crops
+	crops []uint64
+	// variants are hashes of the flipped and rotated picture
+	variants []variantHashes
+	// untrimmedPHash and untrimmedDHash are hashes of the picture with its borders,
+	// nil if it has none. Pictures saved before borders were trimmed are found by them.
+	untrimmedPHash, untrimmedDHash *goimagehash.ImageHash
+}
+
+// hashPicture returns hashes of the picture and sha256 of the downloaded file
+func (b *BayanBot) hashPicture(ctx context.Context, api *bot.Bot, pic *pictureFile) (hashes *pictureHashes, sum string, err error) {
 	file, err := b.downloadFile(ctx, api, pic.FileID)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "failed to download file")
+		return nil, "", errors.Wrap(err, "failed to download file")
 	}
 
-	img, err := jpeg.Decode(file)
+	checksum := sha256.New()
+	img, err := decodeImage(io.TeeReader(file, checksum), pic.MimeType)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "failed to decode image")
+		return nil, "", errors.Wrap(err, "failed to decode image")
+	}
+
+	// Decoders may stop before the end of the file
+	_, err = io.Copy(checksum, file)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "failed to read file")
 	}
 
 	err = file.Close()
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "failed to close file")
+		return nil, "", errors.Wrap(err, "failed to close file")
 	}
 
-	pHash, err = goimagehash.PerceptionHash(img)
+	flat := flattenAlpha(img)
+	img = trimBorders(flat)
+	hashes = &pictureHashes{}
+
+	if img != flat {
+		hashes.untrimmedPHash, err = goimagehash.PerceptionHash(flat)
+		if err != nil {
+			return nil, "", errors.Wrap(err, "failed to get perception hash of untrimmed picture")
+		}
+
+		hashes.untrimmedDHash, err = goimagehash.DifferenceHash(flat)
+		if err != nil {
+			return nil, "", errors.Wrap(err, "failed to get difference hash of untrimmed picture")
+		}
+	}
+
+	hashes.pHash, err = goimagehash.PerceptionHash(img)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "failed to get perception hash")
+		return nil, "", errors.Wrap(err, "failed to get perception hash")
 	}
 
-	dHash, err = goimagehash.DifferenceHash(img)
+	hashes.dHash, err = goimagehash.DifferenceHash(img)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "failed to get difference hash")
+		return nil, "", errors.Wrap(err, "failed to get difference hash")
 	}
 
-	return pHash, dHash, nil
+	hashes.crops, err = cropHashes(img)
+	if err != nil {
+		return nil, "", err
+	}
+
+	hashes.variants, err = hashVariants(img)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "failed to hash transformed picture")
+	}
+
+	return hashes, hex.EncodeToString(checksum.Sum(nil)), nil
 }
 
-func (b *BayanBot) processPicture(ctx context.Context, api *bot.Bot, msg *models.Message, pic models.PhotoSize) error {
-	pHash, dHash, err := b.hashPicture(ctx, api, pic)
+// findExact looks for the same telegram file, so re-forwards are found without downloading them
+func (b *BayanBot) findExact(msg *models.Message, media storage.Media) (similar []*match, save func() error, err error) {
+	same, err := b.store.FindMsgByFileUniqueID(msg.Chat.ID, media.Kind, media.FileUniqueID)
 	if err != nil {
-		return errors.Wrap(err, "failed to hash pictures")
+		return nil, nil, errors.Wrap(err, "failed to find same file")
 	}
 
-	// Will find the first match and stop
-	similar, err := b.store.FindMsgPictureFilter(
-		msg.Chat.ID,
-		1,
-		func(msg *storage.MessagePicture) (dist int, ok bool, err error) {
-			dist, err = pHash.Distance(msg.PHash)
-			if err != nil {
-				return 0, false, errors.Wrap(err, "failed to get distance")
-			}
+	if same == nil {
+		return nil, nil, nil
+	}
 
-			if dist < 10 {
-				b.logger.Debug(
-					"found similar message",
-					zap.Int("distance", dist),
-					zap.Int("id", msg.ID),
-				)
-				return dist, true, nil
-			}
+	b.logger.Debug("found same file", zap.Int("id", same.Msg.ID))
 
-			return dist, false, nil
-		},
-	)
+	save = func() error {
+		err := b.store.SaveMessageCopy(msg, media, same.Msg)
+		if err != nil {
+			return errors.Wrap(err, "failed to save message")
+		}
+
+		return nil
+	}
+
+	return detectedBy(matched(same), media.Kind, storage.AlgorithmFileUniqueID, 0), save, nil
+}
+
+// findPicture hashes the picture and finds similar ones in the chat, closest first.
+// The picture is not saved until save is called, so pictures of one album
+// can be checked before any of them is saved.
+func (b *BayanBot) findPicture(ctx context.Context, api *bot.Bot, msg *models.Message, pic *pictureFile) (similar []*match, save func() error, err error) {
+	similar, save, err = b.findExact(msg, pic.Media)
+	if err != nil || similar != nil {
+		return similar, save, err
+	}
+
+	hashes, sum, err := b.hashPicture(ctx, api, pic)
 	if err != nil {
-		return errors.Wrap(err, "failed to find similar messages")
+		return nil, nil, errors.Wrap(err, "failed to hash pictures")
+	}
+
+	media := pic.Media
+	media.SHA256 = sum
+	save = func() error {
+		err := b.store.SaveMessagePicture(msg, media, hashes.pHash, hashes.dHash, hashes.crops)
+		if err != nil {
+			return errors.Wrap(err, "failed to save message")
+		}
+
+		return nil
+	}
+
+	// Same bytes under a different telegram file
+	same, err := b.store.FindMsgBySHA256(msg.Chat.ID, media.Kind, sum)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to find same file")
+	}
+
+	if same != nil {
+		return detectedBy(matched(same), media.Kind, storage.AlgorithmSHA256, 0), save, nil
+	}
+
+	threshold, err := b.threshold(msg.Chat.ID, mediaOf(media.Kind, false))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// All matches are needed to link the original
+	found, err := b.findScoredPictures(msg.Chat.ID, media.Kind, hashes.pHash, hashes.dHash, threshold)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to find similar messages")
+	}
+
+	for _, variant := range hashes.variants {
+		transformed, err := b.findScoredPictures(msg.Chat.ID, media.Kind, variant.pHash, variant.dHash, threshold)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to find transformed messages")
+		}
+		found = append(found, transformedBy(transformed, variant.transform)...)
+	}
+
+	if hashes.untrimmedPHash != nil {
+		untrimmed, err := b.findScoredPictures(msg.Chat.ID, media.Kind, hashes.untrimmedPHash, hashes.untrimmedDHash, threshold)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to find untrimmed messages")
+		}
+		found = append(found, untrimmed...)
+	}
+
+	cropped, err := b.findCropped(msg.Chat.ID, media.Kind, hashes.pHash.GetHash(), hashes.crops, threshold)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to find cropped messages")
+	}
+	similar = b.splitByConfidence(msg, bestMatches(append(found, cropped...)))
+
+	b.logSimilar(similar)
+
+	return similar, save, nil
+}
+
+// findScoredPictures finds pictures by the pHash and scores them by both hashes
+func (b *BayanBot) findScoredPictures(chatID int64, kind storage.MediaKind, pHash, dHash *goimagehash.ImageHash, threshold int) ([]*match, error) {
+	pFound, err := b.store.FindPicturesNear(chatID, kind, storage.HashPerception, pHash.GetHash(), searchThreshold(threshold), 0)
+	if err != nil {
+		return nil, err
+	}
+	found := detectedBy(matched(pFound...), kind, storage.AlgorithmPHash, threshold)
+
+	if len(found) > 0 {
+		dFound, err := b.store.FindPicturesNear(chatID, kind, storage.HashDifference, dHash.GetHash(), searchThreshold(compareThreshold(threshold)), 0)
+		if err != nil {
+			return nil, err
+		}
+		fuseDifference(found, matched(dFound...), threshold)
+	}
+
+	return found, nil
+}
+
+func (b *BayanBot) processPicture(ctx context.Context, api *bot.Bot, msg *models.Message, pic *pictureFile) error {
+	similar, save, err := b.findPicture(ctx, api, msg, pic)
+	if err != nil {
+		return err
 	}
 
 	if len(similar) > 0 {
-		err := b.replyBayan(ctx, api, msg, similar[0])
+		err := b.replyBayan(ctx, api, msg, similar...)
 		if err != nil {
 			return errors.Wrap(err, "failed to reply bayan")
 		}
 	}
 
-	err = b.store.SaveMessagePicture(msg, pHash, dHash)
-	if err != nil {
-		return errors.Wrap(err, "failed to save message")
+	return save()
+}
+
+// messageLink returns a link to the message in a supergroup
+func messageLink(msg *storage.Message) string {
+	chatID := (msg.ChatID + 1000000000000) * -1
+	return fmt.Sprintf("https://t.me/c/%d/%d", chatID, msg.ID)
+}
+
+// replyMatch is which of the found messages a bayan reply links to
+type replyMatch string
+
+const (
+	// replyClosest links the most similar message
+	replyClosest replyMatch = "closest"
+	// replyOriginal links the first posted of the similar messages
+	replyOriginal replyMatch = "original"
+	// replyBoth links both of them, or one if they are the same message
+	replyBoth replyMatch = "both"
+)
+
+// logSimilar logs the most likely of the found messages
+func (b *BayanBot) logSimilar(similar []*match) {
+	if len(similar) == 0 {
+		return
 	}
 
-	return nil
+	b.logger.Debug(
+		"found similar message",
+		zap.Int("distance", similar[0].Distance),
+		zap.Int("score", similar[0].score),
+		zap.Int("id", similar[0].Msg.ID),
+		zap.Int("matches", len(similar)),
+	)
 }
 
-func (b *BayanBot) replyBayan(ctx context.Context, api *bot.Bot, msg *models.Message, similar *storage.SimilarMessage) error {
-	chatID := (similar.Msg.ChatID + 1000000000000) * -1
-	var text string
-	if b.showSimilarity {
-		text = fmt.Sprintf("[Баян](https://t.me/c/%d/%d) (distance: %d)\n", chatID, similar.Msg.ID, similar.Distance)
-	} else {
-		text = fmt.Sprintf("[Баян](https://t.me/c/%d/%d)\n", chatID, similar.Msg.ID)
+// firstPosted returns the earliest of the messages
+func firstPosted(similar []*match) *match {
+	first := similar[0]
+	for _, s := range similar[1:] {
+		if s.Msg.SentDate.Before(first.Msg.SentDate) ||
+			s.Msg.SentDate.Equal(first.Msg.SentDate) && s.Msg.ID < first.Msg.ID {
+			first = s
+		}
+	}
+	return first
+}
+
+// bayanLinks formats links to the messages chosen by the reply preference.
+// similar must be sorted the most likely first, its confidence picks the title.
+func (b *BayanBot) bayanLinks(similar []*match) string {
+	link := func(title string, s *match) string {
+		var details []string
+		if s.part != nil {
+			details = append(details, partTitle(s.part))
+		}
+		if b.showSimilarity {
+			if s.transform != "" {
+				details = append(details, s.transform.title())
+			}
+			details = append(details, fmt.Sprintf("distance: %d, score: %d%%", s.Distance, s.score))
+		}
+
+		text := fmt.Sprintf("[%s](%s)", title, messageLink(s.Msg))
+		if len(details) > 0 {
+			text += " (" + strings.Join(details, ", ") + ")"
+		}
+		return text
+	}
+
+	closest, original := similar[0], firstPosted(similar)
+	title := bayanTitle(confidenceOf(closest.score))
+	switch {
+	case b.replyMatch == replyOriginal:
+		return link(title, original)
+	case b.replyMatch == replyBoth && original != closest:
+		return link(title, closest) + ", " + link("оригинал", original)
+	default:
+		return link(title, closest)
 	}
+}
+
+// bayanTitle is the reply to a repost of the confidence.
+// Possible reposts are replied to only after admins confirm them.
+func bayanTitle(level confidence) string {
+	if level == confidenceLikely {
+		return "Похоже на баян"
+	}
+	return "Баян"
+}
+
+// replyBayan adds the message to the cluster of the similar messages and replies with links to them.
+// similar must be sorted the most likely first.
+func (b *BayanBot) replyBayan(ctx context.Context, api *bot.Bot, msg *models.Message, similar ...*match) error {
+	cluster := b.recordRepost(msg, similar)
 
 	_, err := api.SendMessage(ctx, &bot.SendMessageParams{
 		ChatID:          msg.Chat.ID,
-		Text:            text,
+		Text:            b.bayanLinks(similar) + clusterCount(cluster) + "\n" + clusterPosters(cluster, msg.ID),
 		ReplyParameters: &models.ReplyParameters{MessageID: msg.ID},
 		ParseMode:       models.ParseModeMarkdown,
 	})
@@ -225,37 +615,22 @@ func (b *BayanBot) replyBayan(ctx context.Context, api *bot.Bot, msg *models.Mes
 	return nil
 }
 
-func (b *BayanBot) comparePicture(ctx context.Context, api *bot.Bot, msg *models.Message, pic models.PhotoSize) error {
-	_, dHash, err := b.hashPicture(ctx, api, pic)
+func (b *BayanBot) comparePicture(ctx context.Context, api *bot.Bot, msg *models.Message, pic *pictureFile) error {
+	hashes, _, err := b.hashPicture(ctx, api, pic)
 	if err != nil {
 		return errors.Wrap(err, "failed to hash pictures")
 	}
 
-	// Will find all similar messages
-	similar, err := b.store.FindMsgPictureFilter(msg.Chat.ID, 0, func(m *storage.MessagePicture) (dist int, ok bool, err error) {
-		if m.ID == msg.ReplyToMessage.ID {
-			return 0, false, nil
-		}
-
-		dist, err = dHash.Distance(m.DHash)
-		if err != nil {
-			return 0, false, errors.Wrap(err, "failed to get distance")
-		}
-
-		if dist < 15 {
-			b.logger.Debug(
-				"found similar message",
-				zap.Int("distance", dist),
-				zap.Int("id", m.ID),
-			)
-			return dist, true, nil
-		}
+	threshold, err := b.threshold(msg.Chat.ID, mediaOf(pic.Media.Kind, false))
+	if err != nil {
+		return err
+	}
 
-		return dist, false, nil
-	})
+	found, err := b.store.FindPicturesNear(msg.Chat.ID, pic.Media.Kind, storage.HashDifference, hashes.dHash.GetHash(), compareThreshold(threshold), 0)
 	if err != nil {
 		return errors.Wrap(err, "failed to find similar messages")
 	}
+	similar := excludeMessage(matched(found...), msg.ReplyToMessage.ID)
 
 	if len(similar) > 0 {
 		err := b.replySimilar(ctx, api, msg, similar)
@@ -263,7 +638,7 @@ func (b *BayanBot) comparePicture(ctx context.Context, api *bot.Bot, msg *models
 			return errors.Wrap(err, "failed to reply bayan")
 		}
 	} else {
-		_, err = api.SendMessage(ctx, &bot.SendMessageParams{
+		_, err := api.SendMessage(ctx, &bot.SendMessageParams{
 			ChatID:          msg.Chat.ID,
 			Text:            "Похожих постов не видел",
 			ReplyParameters: &models.ReplyParameters{MessageID: msg.ID},
@@ -276,6 +651,17 @@ func (b *BayanBot) comparePicture(ctx context.Context, api *bot.Bot, msg *models
 	return nil
 }
 
+// excludeMessage removes the message /compare was called on from the results
+func excludeMessage(similar []*match, id int) []*match {
+	var filtered []*match
+	for _, msg := range similar {
+		if msg.Msg.ID != id {
+			filtered = append(filtered, msg)
+		}
+	}
+	return filtered
+}
+
 func (b *BayanBot) compareCmd(ctx context.Context, api *bot.Bot, update *models.Update) {
 	if update.Message.ReplyToMessage == nil {
 		_, err := api.SendMessage(ctx, &bot.SendMessageParams{
@@ -290,16 +676,66 @@ func (b *BayanBot) compareCmd(ctx context.Context, api *bot.Bot, update *models.
 	}
 
 	if update.Message.ReplyToMessage.Photo != nil {
-		err := b.comparePicture(ctx, api, update.Message, update.Message.ReplyToMessage.Photo[0])
+		err := b.comparePicture(ctx, api, update.Message, pictureFromPhoto(update.Message.ReplyToMessage.Photo[0]))
 		if err != nil {
-			b.logger.Error("failed to process pictures", zap.Error(err))
+			b.logMediaError("failed to process pictures", err)
 		}
 	}
 
 	if update.Message.ReplyToMessage.Video != nil {
-		err := b.compareVideo(ctx, api, update.Message)
+		err := b.compareVideo(ctx, api, update.Message, videoFromVideo(update.Message.ReplyToMessage.Video))
+		if err != nil {
+			b.logMediaError("failed to process video", err)
+		}
+	}
+
+	if update.Message.ReplyToMessage.Animation != nil {
+		err := b.compareVideo(ctx, api, update.Message, videoFromAnimation(update.Message.ReplyToMessage.Animation))
+		if err != nil {
+			b.logMediaError("failed to process animation", err)
+		}
+	}
+
+	if update.Message.ReplyToMessage.VideoNote != nil {
+		err := b.compareVideo(ctx, api, update.Message, videoFromVideoNote(update.Message.ReplyToMessage.VideoNote))
+		if err != nil {
+			b.logMediaError("failed to process video note", err)
+		}
+	}
+
+	if update.Message.ReplyToMessage.Voice != nil {
+		err := b.compareAudio(ctx, api, update.Message, audioFromVoice(update.Message.ReplyToMessage.Voice))
+		if err != nil {
+			b.logMediaError("failed to process voice", err)
+		}
+	}
+
+	if update.Message.ReplyToMessage.Audio != nil {
+		err := b.compareAudio(ctx, api, update.Message, audioFromAudio(update.Message.ReplyToMessage.Audio))
+		if err != nil {
+			b.logMediaError("failed to process audio", err)
+		}
+	}
+
+	if update.Message.ReplyToMessage.Sticker != nil {
+		err := b.compareSticker(ctx, api, update.Message, update.Message.ReplyToMessage.Sticker)
+		if err != nil {
+			b.logMediaError("failed to process sticker", err)
+		}
+	}
+
+	if update.Message.ReplyToMessage.Document != nil && update.Message.ReplyToMessage.Animation == nil {
+		err := b.compareDocument(ctx, api, update.Message, update.Message.ReplyToMessage.Document)
+		if err != nil {
+			b.logMediaError("failed to process document", err)
+		}
+	}
+
+	// Short captions are skipped, the media is what is compared then
+	if update.Message.ReplyToMessage.Text != "" || b.isLongText(update.Message.ReplyToMessage.Caption) {
+		err := b.compareText(ctx, api, update.Message)
 		if err != nil {
-			b.logger.Error("failed to process video", zap.Error(err))
+			b.logger.Error("failed to process text", zap.Error(err))
 		}
 	}
 
@@ -316,12 +752,16 @@ func (b *BayanBot) compareCmd(ctx context.Context, api *bot.Bot, update *models.
 	}
 }
 
-func (b *BayanBot) replySimilar(ctx context.Context, api *bot.Bot, msg *models.Message, similar []*storage.SimilarMessage) error {
+func (b *BayanBot) replySimilar(ctx context.Context, api *bot.Bot, msg *models.Message, similar []*match) error {
 	text := "Что-то похожее:\n"
 	for _, s := range similar {
-		chatID := (s.Msg.ChatID + 1000000000000) * -1
-		text += fmt.Sprintf("- https://t.me/c/%d/%d\n", chatID, s.Msg.ID)
+		if s.part != nil {
+			text += fmt.Sprintf("- %s (%s)\n", messageLink(s.Msg), partTitle(s.part))
+			continue
+		}
+		text += fmt.Sprintf("- %s\n", messageLink(s.Msg))
 	}
+	text += clusterLinks(b.getCluster(msg.Chat.ID, msg.ReplyToMessage.ID))
 
 	_, err := api.SendMessage(ctx, &bot.SendMessageParams{
 		ChatID:          msg.Chat.ID,
@@ -335,44 +775,145 @@ func (b *BayanBot) replySimilar(ctx context.Context, api *bot.Bot, msg *models.M
 	return nil
 }
 
-func hashPicFile(path string) (dHash, pHash *goimagehash.ImageHash, err error) {
+// maskCircle crops the image to a centered square and paints everything outside
+// the inscribed circle gray. Video notes are shown as circles, so their corners
+// are never seen and can differ between copies of the same video.
+func maskCircle(img image.Image) image.Image {
+	bounds := img.Bounds()
+	size := min(bounds.Dx(), bounds.Dy())
+	offsetX := bounds.Min.X + (bounds.Dx()-size)/2
+	offsetY := bounds.Min.Y + (bounds.Dy()-size)/2
+
+	masked := image.NewRGBA(image.Rect(0, 0, size, size))
+	radius := float64(size) / 2
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			dx := float64(x) + 0.5 - radius
+			dy := float64(y) + 0.5 - radius
+			if dx*dx+dy*dy > radius*radius {
+				masked.Set(x, y, color.Gray{Y: 128})
+				continue
+			}
+
+			masked.Set(x, y, img.At(offsetX+x, offsetY+y))
+		}
+	}
+
+	return masked
+}
+
+// hashPicFile returns hashes of the frame and of its transforms
+func hashPicFile(path string, round bool) (pHash, dHash *goimagehash.ImageHash, variants []variantHashes, err error) {
 	file, err := os.Open(path)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "failed to open file")
+		return nil, nil, nil, errors.Wrap(err, "failed to open file")
 	}
+	defer file.Close()
 
-	img, err := jpeg.Decode(file)
+	img, err := decodeImage(file, "")
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "failed to decode image")
+		return nil, nil, nil, errors.Wrap(err, "failed to decode image")
+	}
+
+	if round {
+		img = maskCircle(img)
 	}
 
 	pHash, err = goimagehash.PerceptionHash(img)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "failed to get perception hash")
+		return nil, nil, nil, errors.Wrap(err, "failed to get perception hash")
 	}
 
 	dHash, err = goimagehash.DifferenceHash(img)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "failed to get perception hash")
+		return nil, nil, nil, errors.Wrap(err, "failed to get perception hash")
 	}
 
-	return pHash, dHash, nil
+	variants, err = hashVariants(img)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "failed to hash transformed frame")
+	}
+
+	return pHash, dHash, variants, nil
+}
+
+// videoFile is the part of videos, animations (GIFs) and video notes needed to fingerprint them.
+type videoFile struct {
+	FileID    string
+	FileSize  int64
+	Thumbnail *models.PhotoSize
+	Media     storage.Media
 }
 
-func (b *BayanBot) hashVideo(ctx context.Context, api *bot.Bot, video *models.Video) (pHashes, dHashes *storage.VideoHashes, err error) {
-	pHashes = &storage.VideoHashes{}
-	dHashes = &storage.VideoHashes{}
+// videoFrames are hashes of frames of a video
+type videoFrames struct {
+	hashes *storage.VideoHashes
+	// variants are hashes of the flipped and rotated frames
+	variants []videoVariant
+}
 
+type videoVariant struct {
+	transform transform
+	hashes    *storage.VideoHashes
+}
+
+func videoFromVideo(video *models.Video) *videoFile {
+	return &videoFile{
+		FileID:    video.FileID,
+		FileSize:  video.FileSize,
+		Thumbnail: video.Thumbnail,
+		Media:     storage.Media{FileUniqueID: video.FileUniqueID},
+	}
+}
+
+// videoFromDocument is for mp4 and webm videos sent as files
+func videoFromDocument(doc *models.Document) *videoFile {
+	return &videoFile{
+		FileID:    doc.FileID,
+		FileSize:  doc.FileSize,
+		Thumbnail: doc.Thumbnail,
+		Media:     storage.Media{FileUniqueID: doc.FileUniqueID},
+	}
+}
+
+// videoFromVideoNote marks the video as round, so only the inscribed circle is hashed
+func videoFromVideoNote(note *models.VideoNote) *videoFile {
+	return &videoFile{
+		FileID:    note.FileID,
+		FileSize:  int64(note.FileSize),
+		Thumbnail: note.Thumbnail,
+		Media: storage.Media{
+			Kind:         storage.KindVideoNote,
+			FileUniqueID: note.FileUniqueID,
+		},
+	}
+}
+
+// videoFromAnimation works for GIFs too, because telegram converts them to mp4 animations
+func videoFromAnimation(animation *models.Animation) *videoFile {
+	return &videoFile{
+		FileID:    animation.FileID,
+		FileSize:  animation.FileSize,
+		Thumbnail: animation.Thumbnail,
+		Media:     storage.Media{FileUniqueID: animation.FileUniqueID},
+	}
+}
+
+// errNotEnoughFrames is returned for videos no frames could be taken from
+var errNotEnoughFrames = errors.New("not enough frames")
+
+// hashVideo hashes frames of the video and fingerprints its sound. track is nil for videos without sound.
+func (b *BayanBot) hashVideo(ctx context.Context, api *bot.Bot, video *videoFile) (frames *videoFrames, track *storage.AudioTrack, sum string, err error) {
 	file, err := b.downloadFile(ctx, api, video.FileID)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "failed to download file")
+		return nil, nil, "", errors.Wrap(err, "failed to download file")
 	}
 
 	// Create temp dir
 	dirName := bot.RandomString(10)
 	err = os.Mkdir(dirName, 0755)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "failed to create temp dir")
+		return nil, nil, "", errors.Wrap(err, "failed to create temp dir")
 	}
 
 	// Cleanup
@@ -387,233 +928,301 @@ func (b *BayanBot) hashVideo(ctx context.Context, api *bot.Bot, video *models.Vi
 	fileName := fmt.Sprintf("%s/%s.mp4", dirName, video.FileID)
 	f, err := os.Create(fileName)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "failed to create file")
+		return nil, nil, "", errors.Wrap(err, "failed to create file")
 	}
 
-	_, err = io.Copy(f, file)
+	checksum := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, checksum), file)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "failed to copy file")
+		return nil, nil, "", errors.Wrap(err, "failed to copy file")
 	}
 
 	err = file.Close()
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "failed to close file")
+		return nil, nil, "", errors.Wrap(err, "failed to close file")
 	}
 
 	err = f.Close()
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "failed to close file")
+		return nil, nil, "", errors.Wrap(err, "failed to close file")
 	}
 
-	// Extract scenes from video
-	err = exec.Command("ffmpeg", "-i", fileName, "-vf", "select=gt(scene,0.2)", "-vsync", "vfr", "-vf", "fps=1", dirName+"/out%d.jpg").Run()
+	duration := probeDuration(ctx, fileName)
+	scenes, even, err := extractScenes(ctx, fileName, dirName, b.sceneSensitivity, duration)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "failed to extract scenes from video")
+		return nil, nil, "", errors.Wrap(err, "failed to extract frames")
 	}
 
-	// Get frames count
-	files, err := os.ReadDir(dirName)
+	frames, err = hashFrames(scenes, even, duration, video.Media.Kind == storage.KindVideoNote)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "failed to read dir")
+		return nil, nil, "", errors.Wrap(err, "failed to hash frames")
 	}
 
-	if len(files) < 4 {
-		return nil, nil, errors.New("not enough frames")
+	// Animations and muted videos have no audio stream, ffmpeg fails on them
+	samples, err := extractSamples(ctx, fileName)
+	if err != nil {
+		b.logger.Debug("video has no sound", zap.Error(err))
+	} else if fingerprint := audio.Fingerprint(samples); len(fingerprint) > 0 {
+		track = &storage.AudioTrack{
+			Duration:    len(samples) / audio.SampleRate,
+			Fingerprint: fingerprint,
+		}
 	}
 
-	// Hash frames
-	framesPHashes, framesDHashes, err := hashFrames(dirName, files)
-	if err != nil {
-		return nil, nil, errors.Wrap(err, "failed to hash frames")
+	return frames, track, hex.EncodeToString(checksum.Sum(nil)), nil
+}
+
+// hashFrames hashes the scenes, then drops repeated frames, see distinctFrames.
+// even is true if the scenes were taken evenly.
+func hashFrames(scenes []videoScene, even bool, duration time.Duration, round bool) (*videoFrames, error) {
+	pHashes := make([]*goimagehash.ImageHash, len(scenes))
+	dHashes := make([]*goimagehash.ImageHash, len(scenes))
+	variants := make([][]variantHashes, len(scenes))
+	for i, scene := range scenes {
+		var err error
+		pHashes[i], dHashes[i], variants[i], err = hashPicFile(scene.path, round)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to hash picture")
+		}
+	}
+
+	frameHashes := make([]uint64, len(scenes))
+	times := make([]time.Duration, len(scenes))
+	for i, scene := range scenes {
+		frameHashes[i], times[i] = pHashes[i].GetHash(), scene.time
+	}
+	kept, duration := distinctFrames(frameHashes, times, duration, even)
+
+	frames := &videoFrames{hashes: &storage.VideoHashes{Duration: duration}}
+	for _, t := range transforms {
+		frames.variants = append(frames.variants, videoVariant{
+			transform: t,
+			hashes:    &storage.VideoHashes{Duration: duration},
+		})
+	}
+
+	for _, i := range kept {
+		appendFrame(frames.hashes, pHashes[i], dHashes[i], times[i])
+		for j, variant := range variants[i] {
+			appendFrame(frames.variants[j].hashes, variant.pHash, variant.dHash, times[i])
+		}
 	}
 
-	return framesPHashes, framesDHashes, nil
+	return frames, nil
 }
 
-func hashFrames(dirName string, files []os.DirEntry) (framesPHashes, framesDHashes *storage.VideoHashes, err error) {
-	framesPHashes = &storage.VideoHashes{}
-	framesDHashes = &storage.VideoHashes{}
+func appendFrame(hashes *storage.VideoHashes, pHash, dHash *goimagehash.ImageHash, shownAt time.Duration) {
+	hashes.PHashes = append(hashes.PHashes, pHash)
+	hashes.DHashes = append(hashes.DHashes, dHash)
+	hashes.Times = append(hashes.Times, shownAt)
+}
+
+// findVideo works like findPicture. Videos too big to download are checked by their thumbnails.
+func (b *BayanBot) findVideo(ctx context.Context, api *bot.Bot, message *models.Message, video *videoFile) (similar []*match, save func() error, err error) {
+	if video.FileSize > maxDownloadSize {
+		// Thumbnails of round videos are not masked, so they would not match anything
+		if video.Thumbnail == nil || video.Media.Kind == storage.KindVideoNote {
+			return nil, func() error { return nil }, nil
+		}
+
+		// TODO: Check if thumbnail is mostly black
+		similar, save, err = b.findPicture(ctx, api, message, pictureFromPhoto(*video.Thumbnail))
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to process video thumbnail")
+		}
+
+		return similar, save, nil
+	}
+
+	similar, save, err = b.findExact(message, video.Media)
+	if err != nil || similar != nil {
+		return similar, save, err
+	}
 
-	fileA := dirName + "/" + files[1].Name()
-	pHashA, dHashA, err := hashPicFile(fileA)
+	frames, track, sum, err := b.hashVideo(ctx, api, video)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "failed to hash picture")
+		return nil, nil, errors.Wrap(err, "failed to hash video")
 	}
-	framesPHashes.FrameA = pHashA
-	framesDHashes.FrameA = dHashA
 
-	fileB := dirName + "/" + files[len(files)/4].Name()
-	pHashB, dHashB, err := hashPicFile(fileB)
+	media := video.Media
+	media.SHA256 = sum
+	save = func() error {
+		err := b.store.SaveMessageVideo(message, media, frames.hashes, track)
+		if err != nil {
+			return errors.Wrap(err, "failed to save message")
+		}
+
+		return nil
+	}
+
+	// Same bytes under a different telegram file
+	same, err := b.store.FindMsgBySHA256(message.Chat.ID, media.Kind, sum)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "failed to hash picture")
+		return nil, nil, errors.Wrap(err, "failed to find same file")
 	}
-	framesPHashes.FrameB = pHashB
-	framesDHashes.FrameB = dHashB
 
-	fileC := dirName + "/" + files[len(files)-len(files)/4].Name()
-	pHashC, dHashC, err := hashPicFile(fileC)
+	if same != nil {
+		return detectedBy(matched(same), media.Kind, storage.AlgorithmSHA256, 0), save, nil
+	}
+
+	threshold, err := b.threshold(message.Chat.ID, mediaOf(media.Kind, true))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sameSound, err := b.findSameSound(message.Chat.ID, media.Kind, track)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "failed to hash picture")
+		return nil, nil, errors.Wrap(err, "failed to find the same sound")
 	}
-	framesPHashes.FrameC = pHashC
-	framesDHashes.FrameC = dHashC
 
-	fileD := dirName + "/" + files[len(files)-2].Name()
-	pHashD, dHashD, err := hashPicFile(fileD)
+	found, err := b.findScoredVideos(message.Chat.ID, media.Kind, frames.hashes, track, sameSound, threshold)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "failed to hash picture")
+		return nil, nil, errors.Wrap(err, "failed to find similar messages")
 	}
-	framesPHashes.FrameD = pHashD
-	framesDHashes.FrameD = dHashD
 
-	return framesPHashes, framesDHashes, nil
+	for _, variant := range frames.variants {
+		transformed, err := b.findScoredVideos(message.Chat.ID, media.Kind, variant.hashes, track, sameSound, threshold)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to find transformed messages")
+		}
+		found = append(found, transformedBy(transformed, variant.transform)...)
+	}
+	similar = b.splitByConfidence(message, bestMatches(found))
+
+	b.logSimilar(similar)
+
+	return similar, save, nil
 }
 
-func (b *BayanBot) processVideo(ctx context.Context, api *bot.Bot, message *models.Message) error {
-	if message.Video.FileSize > 20*1024*1024 {
-		err := b.processVideoThumbnail(ctx, api, message)
+// findScoredVideos finds videos by frame pHashes and sound, and scores them by dHashes too
+func (b *BayanBot) findScoredVideos(chatID int64, kind storage.MediaKind, hashes *storage.VideoHashes, track *storage.AudioTrack, sameSound []*storage.SimilarMessage, threshold int) ([]*match, error) {
+	found, err := b.findSimilarVideos(chatID, kind, storage.HashPerception, hashes, track, sameSound, searchThreshold(threshold), 0)
+	if err != nil {
+		return nil, err
+	}
+
+	algorithm := storage.AlgorithmVideoPHash
+	if track != nil {
+		algorithm = storage.AlgorithmVideoAudio
+	}
+	found = detectedBy(found, kind, algorithm, threshold)
+
+	if len(found) > 0 {
+		dFound, err := b.findSimilarVideos(chatID, kind, storage.HashDifference, hashes, track, sameSound, searchThreshold(compareThreshold(threshold)), 0)
 		if err != nil {
-			return errors.Wrap(err, "failed to process video thumbnail")
+			return nil, err
 		}
+		fuseDifference(found, dFound, threshold)
+	}
 
-		return nil
+	return found, nil
+}
+
+// findSimilarVideos finds videos with frames and sound closer than threshold, sorted by sortSimilar.
+// Frames of a re-cut clip may be too far for the index, such clips come from sameSound, see findSameSound.
+func (b *BayanBot) findSimilarVideos(chatID int64, kind storage.MediaKind, hashType storage.HashType, hashes *storage.VideoHashes, track *storage.AudioTrack, sameSound []*storage.SimilarMessage, threshold, limit int) ([]*match, error) {
+	if track == nil {
+		found, err := b.store.FindVideosNear(chatID, kind, hashType, hashes, threshold, limit)
+		if err != nil {
+			return nil, err
+		}
+		return matchedVideos(found), nil
 	}
 
-	framesPHashes, framesDHashes, err := b.hashVideo(ctx, api, message.Video)
+	// The sound can move candidates in both directions, so all of them are needed
+	found, err := b.store.FindVideosNear(chatID, kind, hashType, hashes, threshold, 0)
 	if err != nil {
-		return errors.Wrap(err, "failed to hash video")
+		return nil, err
 	}
 
-	similar, err := b.store.FindMsgVideoFilter(
-		message.Chat.ID,
-		1,
-		func(msg *storage.MessageVideo) (dist int, ok bool, err error) {
-			// Calculate average distance
-			dist = 0
-			distA, err := framesPHashes.FrameA.Distance(msg.PHashes.FrameA)
-			if err != nil {
-				return 0, false, errors.Wrap(err, "failed to get distance")
-			}
+	var similar []*match
+	seen := make(map[int]bool)
+	for _, candidate := range matchedVideos(found) {
+		seen[candidate.Msg.ID] = true
 
-			distB, err := framesPHashes.FrameB.Distance(msg.PHashes.FrameB)
-			if err != nil {
-				return 0, false, errors.Wrap(err, "failed to get distance")
-			}
+		stored, err := b.store.GetAudioTrack(chatID, candidate.Msg.ID)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get audio track")
+		}
 
-			distC, err := framesPHashes.FrameC.Distance(msg.PHashes.FrameC)
-			if err != nil {
-				return 0, false, errors.Wrap(err, "failed to get distance")
-			}
+		if stored != nil {
+			candidate.Distance = combinedDistance(candidate.Distance, stored.Fingerprint, track)
+		}
 
-			distD, err := framesPHashes.FrameD.Distance(msg.PHashes.FrameD)
-			if err != nil {
-				return 0, false, errors.Wrap(err, "failed to get distance")
-			}
+		if candidate.Distance < threshold {
+			similar = append(similar, candidate)
+		}
+	}
 
-			dist += distA
-			dist += distB
-			dist += distC
-			dist += distD
-			dist /= 4
-
-			if dist < 10 {
-				b.logger.Debug(
-					"found similar message",
-					zap.Int("distance", dist),
-					zap.Int("id", msg.Msg.ID),
-				)
-				return dist, true, nil
-			}
+	for _, same := range sameSound {
+		if seen[same.Msg.ID] {
+			continue
+		}
 
-			return dist, false, nil
-		},
-	)
+		dist := scaledAudioDistance(same.Distance)
+		if dist < threshold {
+			similar = append(similar, &match{SimilarMessage: &storage.SimilarMessage{Msg: same.Msg, Distance: dist}})
+		}
+	}
+
+	sortSimilar(similar)
+	if limit != 0 && len(similar) > limit {
+		similar = similar[:limit]
+	}
+
+	return similar, nil
+}
+
+func (b *BayanBot) processVideo(ctx context.Context, api *bot.Bot, message *models.Message, video *videoFile) error {
+	similar, save, err := b.findVideo(ctx, api, message, video)
 	if err != nil {
-		return errors.Wrap(err, "failed to find similar messages")
+		return err
 	}
 
 	if len(similar) > 0 {
-		err := b.replyBayan(ctx, api, message, similar[0])
+		err := b.replyBayan(ctx, api, message, similar...)
 		if err != nil {
 			return errors.Wrap(err, "failed to reply bayan")
 		}
 	}
 
-	err = b.store.SaveMessageVideo(message, framesPHashes, framesDHashes)
-	if err != nil {
-		return errors.Wrap(err, "failed to save message")
-	}
-
-	return nil
+	return save()
 }
 
-func (b *BayanBot) compareVideo(ctx context.Context, api *bot.Bot, message *models.Message) error {
-	video := message.ReplyToMessage.Video
-	if message.ReplyToMessage.Video.FileSize > 20*1024*1024 {
-		err := b.processVideoThumbnail(ctx, api, message)
+func (b *BayanBot) compareVideo(ctx context.Context, api *bot.Bot, message *models.Message, video *videoFile) error {
+	if video.FileSize > maxDownloadSize {
+		if video.Thumbnail == nil || video.Media.Kind == storage.KindVideoNote {
+			return nil
+		}
+
+		err := b.comparePicture(ctx, api, message, pictureFromPhoto(*video.Thumbnail))
 		if err != nil {
-			return errors.Wrap(err, "failed to process video thumbnail")
+			return errors.Wrap(err, "failed to compare video thumbnail")
 		}
 
 		return nil
 	}
 
-	_, framesDHashes, err := b.hashVideo(ctx, api, video)
+	frames, track, _, err := b.hashVideo(ctx, api, video)
 	if err != nil {
 		return errors.Wrap(err, "failed to hash video")
 	}
 
-	similar, err := b.store.FindMsgVideoFilter(
-		message.Chat.ID,
-		0,
-		func(msg *storage.MessageVideo) (dist int, ok bool, err error) {
-			if msg.Msg.ID == message.ReplyToMessage.ID {
-				return 0, false, nil
-			}
-
-			// Calculate average distance
-			dist = 0
-			distA, err := framesDHashes.FrameA.Distance(msg.DHashes.FrameA)
-			if err != nil {
-				return 0, false, errors.Wrap(err, "failed to get distance")
-			}
-
-			distB, err := framesDHashes.FrameB.Distance(msg.DHashes.FrameB)
-			if err != nil {
-				return 0, false, errors.Wrap(err, "failed to get distance")
-			}
-
-			distC, err := framesDHashes.FrameC.Distance(msg.DHashes.FrameC)
-			if err != nil {
-				return 0, false, errors.Wrap(err, "failed to get distance")
-			}
-
-			distD, err := framesDHashes.FrameD.Distance(msg.DHashes.FrameD)
-			if err != nil {
-				return 0, false, errors.Wrap(err, "failed to get distance")
-			}
+	threshold, err := b.threshold(message.Chat.ID, mediaOf(video.Media.Kind, true))
+	if err != nil {
+		return err
+	}
 
-			dist += distA
-			dist += distB
-			dist += distC
-			dist += distD
-			dist /= 4
-
-			if dist < 15 {
-				b.logger.Debug(
-					"found similar message",
-					zap.Int("distance", dist),
-					zap.Int("id", msg.Msg.ID),
-				)
-				return dist, true, nil
-			}
+	sameSound, err := b.findSameSound(message.Chat.ID, video.Media.Kind, track)
+	if err != nil {
+		return errors.Wrap(err, "failed to find the same sound")
+	}
 
-			return dist, false, nil
-		},
-	)
+	similar, err := b.findSimilarVideos(message.Chat.ID, video.Media.Kind, storage.HashDifference, frames.hashes, track, sameSound, compareThreshold(threshold), 0)
 	if err != nil {
 		return errors.Wrap(err, "failed to find similar messages")
 	}
+	similar = excludeMessage(similar, message.ReplyToMessage.ID)
 
 	if len(similar) > 0 {
 		err := b.replySimilar(ctx, api, message, similar)
@@ -634,62 +1243,166 @@ func (b *BayanBot) compareVideo(ctx context.Context, api *bot.Bot, message *mode
 	return nil
 }
 
-func (b *BayanBot) processVideoThumbnail(ctx context.Context, api *bot.Bot, msg *models.Message) error {
-	// TODO: Check if thumbnail is mostly black
-
-	pHash, dHash, err := b.hashPicture(ctx, api, *msg.Video.Thumbnail)
-	if err != nil {
-		return errors.Wrap(err, "failed to hash pictures")
+// Images and videos sent "as file" come without compression, so they
+// have to be decoded by their mime type
+var (
+	documentPictureTypes = map[string]bool{
+		"image/jpeg": true,
+		"image/png":  true,
+		"image/webp": true,
+		"image/gif":  true,
+		"image/bmp":  true,
 	}
+	documentVideoTypes = map[string]bool{
+		"video/mp4":  true,
+		"video/webm": true,
+	}
+)
 
-	// Will find the first match and stop
-	similar, err := b.store.FindMsgPictureFilter(
-		msg.Chat.ID,
-		1,
-		func(msg *storage.MessagePicture) (dist int, ok bool, err error) {
-			dist, err = pHash.Distance(msg.PHash)
-			if err != nil {
-				return 0, false, errors.Wrap(err, "failed to get distance")
-			}
-
-			if dist < 10 {
-				b.logger.Debug(
-					"found similar message",
-					zap.Int("distance", dist),
-					zap.Int("id", msg.ID),
-				)
-				return dist, true, nil
+// documentFiles returns either a picture or a video to fingerprint, or neither if
+// the document is something else or is too big and has no thumbnail
+func documentFiles(doc *models.Document) (*pictureFile, *videoFile) {
+	switch {
+	case documentPictureTypes[doc.MimeType]:
+		if doc.FileSize > maxDownloadSize {
+			if doc.Thumbnail == nil {
+				return nil, nil
 			}
+			return pictureFromPhoto(*doc.Thumbnail), nil
+		}
 
-			return dist, false, nil
-		},
-	)
-	if err != nil {
-		return errors.Wrap(err, "failed to find similar messages")
+		return &pictureFile{
+			FileID:   doc.FileID,
+			MimeType: doc.MimeType,
+			Media:    storage.Media{FileUniqueID: doc.FileUniqueID},
+		}, nil
+	case documentVideoTypes[doc.MimeType]:
+		return nil, videoFromDocument(doc)
+	default:
+		return nil, nil
 	}
+}
 
-	if len(similar) > 0 {
-		err := b.replyBayan(ctx, api, msg, similar[0])
+func (b *BayanBot) processDocument(ctx context.Context, api *bot.Bot, msg *models.Message, doc *models.Document) error {
+	pic, video := documentFiles(doc)
+	switch {
+	case pic != nil:
+		err := b.processPicture(ctx, api, msg, pic)
 		if err != nil {
-			return errors.Wrap(err, "failed to reply bayan")
+			return errors.Wrap(err, "failed to process picture")
 		}
+	case video != nil:
+		err := b.processVideo(ctx, api, msg, video)
+		if err != nil {
+			return errors.Wrap(err, "failed to process video")
+		}
+	default:
+		b.logger.Debug("skipping document", zap.String("mime_type", doc.MimeType))
 	}
 
-	err = b.store.SaveMessagePicture(msg, pHash, dHash)
-	if err != nil {
-		return errors.Wrap(err, "failed to save message")
+	return nil
+}
+
+func (b *BayanBot) compareDocument(ctx context.Context, api *bot.Bot, msg *models.Message, doc *models.Document) error {
+	pic, video := documentFiles(doc)
+	switch {
+	case pic != nil:
+		err := b.comparePicture(ctx, api, msg, pic)
+		if err != nil {
+			return errors.Wrap(err, "failed to compare picture")
+		}
+	case video != nil:
+		err := b.compareVideo(ctx, api, msg, video)
+		if err != nil {
+			return errors.Wrap(err, "failed to compare video")
+		}
+	default:
+		_, err := api.SendMessage(ctx, &bot.SendMessageParams{
+			ChatID:          msg.Chat.ID,
+			Text:            "Не умею сравнивать такие файлы",
+			ReplyParameters: &models.ReplyParameters{MessageID: msg.ID},
+		})
+		if err != nil {
+			return errors.Wrap(err, "failed to send message")
+		}
 	}
 
 	return nil
 }
 
 type Environment struct {
-	TelegramToken  string  `env:"BOT_TOKEN,required"`
-	KekReplyChance float64 `env:"KEK_REPLY_CHANCE" envDefault:"0.3"`
-	ShowSimilarity bool    `env:"SHOW_SIMILARITY" envDefault:"false"`
+	TelegramToken   string  `env:"BOT_TOKEN,required"`
+	KekReplyChance  float64 `env:"KEK_REPLY_CHANCE" envDefault:"0.3"`
+	ShowSimilarity  bool    `env:"SHOW_SIMILARITY" envDefault:"false"`
+	StickersEnabled bool    `env:"STICKERS_ENABLED" envDefault:"false"`
+	TextMinLength   int     `env:"TEXT_MIN_LENGTH" envDefault:"300"`
+	HashIndex       bool    `env:"HASH_INDEX" envDefault:"true"`
+	NearMisses      bool    `env:"RECORD_NEAR_MISSES" envDefault:"false"`
+	ReplyMatch      string  `env:"REPLY_MATCH" envDefault:"closest"`
+	DatabaseURL     string  `env:"DATABASE_URL"`
+	SceneThreshold  float64 `env:"SCENE_THRESHOLD" envDefault:"0.2"`
+
+	PhotoThreshold     int `env:"PHOTO_THRESHOLD" envDefault:"10"`
+	VideoThreshold     int `env:"VIDEO_THRESHOLD" envDefault:"10"`
+	VideoNoteThreshold int `env:"VIDEO_NOTE_THRESHOLD" envDefault:"10"`
+	StickerThreshold   int `env:"STICKER_THRESHOLD" envDefault:"10"`
+	TextThreshold      int `env:"TEXT_THRESHOLD" envDefault:"12"`
+	AudioThreshold     int `env:"AUDIO_THRESHOLD" envDefault:"30"`
+}
+
+// databasePath is relative to the working directory
+const databasePath = "bayan.db"
+
+// openStore connects to PostgreSQL when databaseURL is set, otherwise opens the SQLite file
+func openStore(databaseURL string, useIndex bool) (storage.Store, error) {
+	if databaseURL != "" {
+		return storage.NewPostgres(databaseURL)
+	}
+	return storage.New(databasePath, useIndex)
+}
+
+// printSchemaStatus prints the schema version of the database and migrations that will be applied on start
+func printSchemaStatus(databaseURL string) error {
+	var version int
+	var pending []storage.Migration
+	var err error
+	if databaseURL != "" {
+		version, pending, err = storage.PostgresSchemaStatus(databaseURL)
+	} else {
+		version, pending, err = storage.SchemaStatus(databasePath)
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to get schema status")
+	}
+
+	fmt.Printf("Schema version: %d\n", version)
+	if len(pending) == 0 {
+		fmt.Println("No pending migrations")
+		return nil
+	}
+
+	fmt.Println("Pending migrations:")
+	for _, m := range pending {
+		fmt.Printf("  %d: %s\n", m.Version, m.Description)
+	}
+
+	return nil
 }
 
 func main() {
+	schemaStatus := flag.Bool("schema-status", false, "print the database schema version and pending migrations, then exit")
+	flag.Parse()
+
+	// It runs without a bot token, so only the database is taken from the environment
+	if *schemaStatus {
+		err := printSchemaStatus(os.Getenv("DATABASE_URL"))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	logger, err := zap.NewProduction()
 	if err != nil {
 		panic(err)
@@ -701,7 +1414,32 @@ func main() {
 		logger.Fatal("failed to unmarshal environment", zap.Error(err))
 	}
 
-	store, err := storage.New("bayan.db")
+	switch replyMatch(config.ReplyMatch) {
+	case replyClosest, replyOriginal, replyBoth:
+	default:
+		logger.Fatal("REPLY_MATCH must be closest, original or both", zap.String("value", config.ReplyMatch))
+	}
+
+	thresholds := map[thresholdMedia]int{
+		mediaPhoto:     config.PhotoThreshold,
+		mediaVideo:     config.VideoThreshold,
+		mediaVideoNote: config.VideoNoteThreshold,
+		mediaSticker:   config.StickerThreshold,
+		mediaText:      config.TextThreshold,
+		mediaAudio:     config.AudioThreshold,
+	}
+	for media, threshold := range thresholds {
+		err = validThreshold(media, threshold)
+		if err != nil {
+			logger.Fatal("invalid default threshold", zap.Error(err))
+		}
+	}
+
+	if config.SceneThreshold <= 0 || config.SceneThreshold >= 1 {
+		logger.Fatal("SCENE_THRESHOLD must be between 0 and 1", zap.Float64("value", config.SceneThreshold))
+	}
+
+	store, err := openStore(config.DatabaseURL, config.HashIndex)
 	if err != nil {
 		logger.Fatal("failed to create storage", zap.Error(err))
 	}
@@ -711,8 +1449,14 @@ func main() {
 		store,
 		logger,
 		BayanConfig{
-			kekReplyChance: config.KekReplyChance,
-			showSimilarity: config.ShowSimilarity,
+			kekReplyChance:   config.KekReplyChance,
+			showSimilarity:   config.ShowSimilarity,
+			stickersEnabled:  config.StickersEnabled,
+			textMinLength:    config.TextMinLength,
+			replyMatch:       replyMatch(config.ReplyMatch),
+			nearMisses:       config.NearMisses,
+			thresholds:       thresholds,
+			sceneSensitivity: config.SceneThreshold,
 		},
 	)
 
@@ -720,6 +1464,9 @@ func main() {
 		bot.WithDefaultHandler(bayanBot.processMessage),
 		bot.WithMessageTextHandler("/start", bot.MatchTypePrefix, bayanBot.startCmd),
 		bot.WithMessageTextHandler("/compare", bot.MatchTypePrefix, bayanBot.compareCmd),
+		bot.WithMessageTextHandler("/stickers", bot.MatchTypePrefix, bayanBot.stickersCmd),
+		bot.WithMessageTextHandler("/threshold", bot.MatchTypePrefix, bayanBot.thresholdCmd),
+		bot.WithMessageTextHandler("/review", bot.MatchTypePrefix, bayanBot.reviewCmd),
 	}
 
 	b, err := bot.New(config.TelegramToken, opts...)
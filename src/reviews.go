@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"github.com/sleroq/bayan/src/storage"
+	"go.uber.org/zap"
+	"strconv"
+	"strings"
+)
+
+// maxReviewList is how many queued messages /review lists
+const maxReviewList = 10
+
+// reviewedMessage is enough of the reviewed message to reply to it and add it to a cluster.
+// The poster name is kept as the first name, so it's shown the same way.
+func reviewedMessage(r *storage.Review) *models.Message {
+	return &models.Message{
+		ID:   r.Msg.ID,
+		Chat: models.Chat{ID: int64(r.Msg.ChatID)},
+		From: &models.User{ID: int64(r.Msg.UserID), FirstName: r.UserName},
+		Date: int(r.Msg.SentDate.Unix()),
+	}
+}
+
+// reviewList formats possible reposts waiting for review, with the most likely match of each
+func reviewList(reviews []*storage.Review) string {
+	var lines []string
+	listed := make(map[int]bool)
+	for _, r := range reviews {
+		if listed[r.Msg.ID] {
+			continue
+		}
+		listed[r.Msg.ID] = true
+
+		line := fmt.Sprintf("%d. [Пост](%s)", r.Msg.ID, messageLink(r.Msg))
+		if r.UserName != "" {
+			line += " от " + escapeMarkdown(r.UserName)
+		}
+		line += fmt.Sprintf(" похож на [этот](%s) на %d%%", messageLink(r.Match), r.Score)
+		lines = append(lines, line)
+	}
+
+	text := fmt.Sprintf("Возможные баяны (%d):\n", len(lines))
+	text += strings.Join(lines[:min(len(lines), maxReviewList)], "\n") + "\n"
+	if len(lines) > maxReviewList {
+		text += fmt.Sprintf("и ещё %d\n", len(lines)-maxReviewList)
+	}
+
+	return text + "\nБаян: /review yes <номер>\nНе баян: /review no <номер>"
+}
+
+// reviewCmd lists possible reposts and lets admins confirm or dismiss them:
+// /review <yes|no> <number>
+func (b *BayanBot) reviewCmd(ctx context.Context, api *bot.Bot, update *models.Update) {
+	msg := update.Message
+	args := strings.Fields(msg.Text)
+	if len(args) < 3 {
+		reviews, err := b.store.GetReviews(msg.Chat.ID, 0)
+		if err != nil {
+			b.logger.Error("failed to get reviews", zap.Error(err))
+			return
+		}
+
+		if len(reviews) == 0 {
+			b.reply(ctx, api, msg, "Возможных баянов нет")
+			return
+		}
+
+		_, err = api.SendMessage(ctx, &bot.SendMessageParams{
+			ChatID:          msg.Chat.ID,
+			Text:            reviewList(reviews),
+			ReplyParameters: &models.ReplyParameters{MessageID: msg.ID},
+			ParseMode:       models.ParseModeMarkdown,
+		})
+		if err != nil {
+			b.logger.Error("failed to send message", zap.Error(err))
+		}
+		return
+	}
+
+	isAdmin, err := b.isChatAdmin(ctx, api, msg)
+	if err != nil {
+		b.logger.Error("failed to check admin rights", zap.Error(err))
+		return
+	}
+	if !isAdmin {
+		b.reply(ctx, api, msg, "Решать, что баян, могут только админы")
+		return
+	}
+
+	id, err := strconv.Atoi(args[2])
+	if err != nil || args[1] != "yes" && args[1] != "no" {
+		b.reply(ctx, api, msg, "Использование: /review yes|no <номер>")
+		return
+	}
+
+	reviews, err := b.store.GetMessageReviews(msg.Chat.ID, id)
+	if err != nil {
+		b.logger.Error("failed to get message reviews", zap.Error(err))
+		return
+	}
+	if len(reviews) == 0 {
+		b.reply(ctx, api, msg, "Такого поста нет среди возможных баянов")
+		return
+	}
+
+	if args[1] == "yes" {
+		similar := make([]*match, len(reviews))
+		for i, r := range reviews {
+			similar[i] = &match{
+				SimilarMessage: &storage.SimilarMessage{Msg: r.Match, Distance: r.Distance},
+				kind:           r.Kind,
+				algorithm:      r.Algorithm,
+				threshold:      r.Threshold,
+				score:          r.Score,
+			}
+		}
+
+		err = b.replyBayan(ctx, api, reviewedMessage(reviews[0]), similar...)
+		if err != nil {
+			b.logger.Error("failed to reply bayan", zap.Error(err))
+			return
+		}
+	}
+
+	err = b.store.DeleteReviews(msg.Chat.ID, id)
+	if err != nil {
+		b.logger.Error("failed to delete reviews", zap.Error(err))
+		return
+	}
+
+	if args[1] == "yes" {
+		b.reply(ctx, api, msg, "Отметил как баян")
+	} else {
+		b.reply(ctx, api, msg, "Убрал из возможных баянов")
+	}
+}
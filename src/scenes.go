@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/go-faster/errors"
+	"github.com/sleroq/bayan/src/storage"
+	"math/bits"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// minSceneFrames is how many scene changes a video needs, clips with fewer
+	// are short or loop smoothly, so frames are taken evenly instead
+	minSceneFrames = 4
+	// evenFrames is how many frames are taken evenly from a video without enough scenes
+	evenFrames = 8
+	// maxVideoFrames is how many frames of long videos with many scenes are hashed
+	maxVideoFrames = 32
+	// repeatedFrameDistance is how close frames have to be to count as the same picture
+	repeatedFrameDistance = 4
+	// loopCoverShare is how much of the video, in percents, the frames have to cover
+	// for it to count as looping, so a clip is not cut because only its start was seen
+	loopCoverShare = 75
+)
+
+// videoScene is a frame extracted from a video
+type videoScene struct {
+	path string
+	// time is when the frame is shown, from the start of the video
+	time time.Duration
+}
+
+// probeDuration returns how long the video is. Some files don't say it, then it's 0.
+func probeDuration(ctx context.Context, path string) time.Duration {
+	out, err := exec.CommandContext(ctx, "ffprobe",
+		"-v", "error",
+		"-show_entries", "format=duration",
+		"-of", "default=noprint_wrappers=1:nokey=1",
+		path,
+	).Output()
+	if err != nil {
+		return 0
+	}
+
+	seconds, err := strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+	if err != nil || seconds < 0 {
+		return 0
+	}
+
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// ptsTime is how showinfo prints the time of a frame
+var ptsTime = regexp.MustCompile(`pts_time:\s*(-?[0-9.]+)`)
+
+// extractFrames saves frames of the video picked by the filter to dir, as name1.jpg, name2.jpg and so on.
+// showinfo prints every saved frame, that's where their times are taken from.
+func extractFrames(ctx context.Context, path, dir, name, filter string) ([]videoScene, error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "ffmpeg",
+		"-hide_banner",
+		"-i", path,
+		"-vf", filter+",showinfo",
+		"-vsync", "vfr",
+		fmt.Sprintf("%s/%s%%d.jpg", dir, name),
+	)
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to run ffmpeg")
+	}
+
+	var scenes []videoScene
+	for i, match := range ptsTime.FindAllStringSubmatch(stderr.String(), -1) {
+		scene := videoScene{path: fmt.Sprintf("%s/%s%d.jpg", dir, name, i+1)}
+		if _, err := os.Stat(scene.path); err != nil {
+			break
+		}
+
+		seconds, err := strconv.ParseFloat(match[1], 64)
+		if err == nil && seconds > 0 {
+			scene.time = time.Duration(seconds * float64(time.Second))
+		}
+		scenes = append(scenes, scene)
+	}
+
+	return scenes, nil
+}
+
+// extractScenes saves the first frame of the video and frames where the scene changes.
+// sensitivity is the scene change score ffmpeg needs, from 0 to 1, lower finds more scenes.
+// Short clips and clips that loop smoothly have few scene changes, frames are taken evenly from them instead,
+// then even is true.
+func extractScenes(ctx context.Context, path, dir string, sensitivity float64, duration time.Duration) (scenes []videoScene, even bool, err error) {
+	scenes, err = extractFrames(ctx, path, dir, "scene", fmt.Sprintf("select='eq(n,0)+gt(scene,%g)'", sensitivity))
+	if err != nil {
+		return nil, false, errors.Wrap(err, "failed to extract scenes")
+	}
+
+	if len(scenes) < minSceneFrames {
+		// Without the duration, frames are taken twice a second
+		rate := "2"
+		if duration > 0 {
+			rate = strconv.FormatFloat(evenFrames/duration.Seconds(), 'f', -1, 64)
+		}
+
+		evenScenes, err := extractFrames(ctx, path, dir, "even", "fps="+rate)
+		if err != nil {
+			return nil, false, errors.Wrap(err, "failed to extract frames evenly")
+		}
+
+		if len(evenScenes) > len(scenes) {
+			scenes, even = evenScenes, true
+		}
+	}
+
+	if len(scenes) == 0 {
+		return nil, false, errNotEnoughFrames
+	}
+
+	return evenlyPicked(scenes, maxVideoFrames), even, nil
+}
+
+// evenlyPicked returns at most limit scenes spread evenly over all of them
+func evenlyPicked(scenes []videoScene, limit int) []videoScene {
+	if len(scenes) <= limit {
+		return scenes
+	}
+
+	picked := make([]videoScene, limit)
+	for i := range picked {
+		picked[i] = scenes[i*len(scenes)/limit]
+	}
+	return picked
+}
+
+func sameFrame(a, b uint64) bool {
+	return bits.OnesCount64(a^b) <= repeatedFrameDistance
+}
+
+// loopLength returns how many frames a looping clip has before it starts over,
+// or the number of frames if it doesn't loop. The clip has to repeat at least once.
+func loopLength(pHashes []uint64) int {
+	for length := 1; 2*length <= len(pHashes); length++ {
+		loops := true
+		for i := length; i < len(pHashes) && loops; i++ {
+			loops = sameFrame(pHashes[i], pHashes[i-length])
+		}
+		if loops {
+			return length
+		}
+	}
+	return len(pHashes)
+}
+
+// distinctFrames returns numbers of frames to keep: a looping clip is cut to its first pass
+// and frames that repeat the previous one are dropped, so a clip matches however many
+// times it loops or however long a still picture is shown.
+// The duration is changed to the length of the first pass.
+// Only evenly taken frames are checked for loops, scenes of a video repeat without it looping.
+// The frames also have to cover most of the duration, it's not known what the rest of the video shows.
+func distinctFrames(pHashes []uint64, times []time.Duration, duration time.Duration, even bool) ([]int, time.Duration) {
+	length := len(pHashes)
+	if even && duration > 0 && times[len(times)-1]*100 >= duration*loopCoverShare {
+		length = loopLength(pHashes)
+	}
+	if length < len(pHashes) {
+		duration = times[length]
+	}
+
+	kept := []int{0}
+	for i := 1; i < length; i++ {
+		if !sameFrame(pHashes[i], pHashes[kept[len(kept)-1]]) {
+			kept = append(kept, i)
+		}
+	}
+
+	return kept, duration
+}
+
+// partTitle says which part of the original video a clip is
+func partTitle(part *storage.VideoPart) string {
+	return fmt.Sprintf("фрагмент %s–%s из %s", clipTime(part.From), clipTime(part.To), clipTime(part.Duration))
+}
+
+// clipTime formats the time like video players do, 1:05 or 1:02:05
+func clipTime(d time.Duration) string {
+	seconds := int(d.Round(time.Second).Seconds())
+	if seconds >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+	}
+	return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// Frames far from each other, and one within repeatedFrameDistance of frameA
+const (
+	frameA     = uint64(0)
+	frameB     = uint64(0xFFFF)
+	frameC     = uint64(0xFFFF0000)
+	frameD     = uint64(0xFFFF00000000)
+	nearFrameA = uint64(0b11)
+)
+
+func TestLoopLength(t *testing.T) {
+	tests := []struct {
+		name    string
+		pHashes []uint64
+		want    int
+	}{
+		{"loops", []uint64{frameA, frameB, frameC, frameA, frameB, frameC, frameA}, 3},
+		{"loops with noise", []uint64{frameA, frameB, nearFrameA, frameB}, 2},
+		{"still picture", []uint64{frameA, frameA, frameA, frameA}, 1},
+		{"no loop", []uint64{frameA, frameB, frameC, frameD}, 4},
+		{"repeats less than once", []uint64{frameA, frameB, frameC, frameA, frameB}, 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := loopLength(tt.pHashes)
+			if got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// evenTimes are times of frames taken one second apart
+func evenTimes(frames int) []time.Duration {
+	times := make([]time.Duration, frames)
+	for i := range times {
+		times[i] = time.Duration(i) * time.Second
+	}
+	return times
+}
+
+func TestDistinctFrames(t *testing.T) {
+	looping := []uint64{frameA, frameB, frameA, frameB, frameA, frameB, frameA, frameB}
+
+	tests := []struct {
+		name         string
+		pHashes      []uint64
+		times        []time.Duration
+		duration     time.Duration
+		even         bool
+		want         []int
+		wantDuration time.Duration
+	}{
+		// Short clips have few scenes, their frames are taken evenly and checked for loops
+		{"loop", looping, evenTimes(8), 8 * time.Second, true, []int{0, 1}, 2 * time.Second},
+		{"scenes", looping, evenTimes(8), 8 * time.Second, false, []int{0, 1, 2, 3, 4, 5, 6, 7}, 8 * time.Second},
+		{"start of long video", looping, evenTimes(8), 20 * time.Second, true, []int{0, 1, 2, 3, 4, 5, 6, 7}, 20 * time.Second},
+		{"unknown duration", looping, evenTimes(8), 0, true, []int{0, 1, 2, 3, 4, 5, 6, 7}, 0},
+		{"still frames", []uint64{frameA, nearFrameA, frameB, frameB, frameC}, evenTimes(5), 5 * time.Second, false, []int{0, 2, 4}, 5 * time.Second},
+		{"too short to loop", []uint64{frameA, frameB, frameC}, evenTimes(3), 3 * time.Second, true, []int{0, 1, 2}, 3 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, duration := distinctFrames(tt.pHashes, tt.times, tt.duration, tt.even)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got frames %v, want %v", got, tt.want)
+			}
+			if duration != tt.wantDuration {
+				t.Errorf("got duration %v, want %v", duration, tt.wantDuration)
+			}
+		})
+	}
+}
+
+func TestEvenlyPicked(t *testing.T) {
+	scenes := make([]videoScene, 10)
+	for i := range scenes {
+		scenes[i].time = time.Duration(i) * time.Second
+	}
+
+	tests := []struct {
+		name  string
+		limit int
+		want  []time.Duration
+	}{
+		{"under the limit", 12, evenTimes(10)},
+		{"over the limit", 4, []time.Duration{0, 2 * time.Second, 5 * time.Second, 7 * time.Second}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []time.Duration
+			for _, scene := range evenlyPicked(scenes, tt.limit) {
+				got = append(got, scene.time)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
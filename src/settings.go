@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"github.com/go-faster/errors"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"github.com/sleroq/bayan/src/storage"
+	"go.uber.org/zap"
+	"strings"
+)
+
+// chatSettings returns settings of the chat, or the defaults if admins never changed them
+func (b *BayanBot) chatSettings(chatID int64) (*storage.ChatSettings, error) {
+	settings, err := b.store.GetChatSettings(chatID)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get chat settings")
+	}
+
+	if settings == nil {
+		settings = &storage.ChatSettings{
+			ChatID:   chatID,
+			Stickers: b.stickersEnabled,
+		}
+	}
+
+	return settings, nil
+}
+
+// isChatAdmin checks if the sender of the message can change chat settings.
+// Everyone is an admin in private chats.
+func (b *BayanBot) isChatAdmin(ctx context.Context, api *bot.Bot, msg *models.Message) (bool, error) {
+	if msg.Chat.Type == models.ChatTypePrivate {
+		return true, nil
+	}
+
+	// Anonymous admins send messages on behalf of the chat
+	if msg.SenderChat != nil && msg.SenderChat.ID == msg.Chat.ID {
+		return true, nil
+	}
+
+	if msg.From == nil {
+		return false, nil
+	}
+
+	member, err := api.GetChatMember(ctx, &bot.GetChatMemberParams{
+		ChatID: msg.Chat.ID,
+		UserID: msg.From.ID,
+	})
+	if err != nil {
+		return false, errors.Wrap(err, "failed to get chat member")
+	}
+
+	return member.Type == models.ChatMemberTypeOwner || member.Type == models.ChatMemberTypeAdministrator, nil
+}
+
+func (b *BayanBot) reply(ctx context.Context, api *bot.Bot, msg *models.Message, text string) {
+	_, err := api.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID:          msg.Chat.ID,
+		Text:            text,
+		ReplyParameters: &models.ReplyParameters{MessageID: msg.ID},
+	})
+	if err != nil {
+		b.logger.Error("failed to send message", zap.Error(err))
+	}
+}
+
+// stickersCmd turns sticker checks on and off: /stickers on|off
+func (b *BayanBot) stickersCmd(ctx context.Context, api *bot.Bot, update *models.Update) {
+	settings, err := b.chatSettings(update.Message.Chat.ID)
+	if err != nil {
+		b.logger.Error("failed to get chat settings", zap.Error(err))
+		return
+	}
+
+	args := strings.Fields(update.Message.Text)
+	if len(args) < 2 {
+		if settings.Stickers {
+			b.reply(ctx, api, update.Message, "Проверка стикеров включена. Выключить: /stickers off")
+		} else {
+			b.reply(ctx, api, update.Message, "Проверка стикеров выключена. Включить: /stickers on")
+		}
+		return
+	}
+
+	isAdmin, err := b.isChatAdmin(ctx, api, update.Message)
+	if err != nil {
+		b.logger.Error("failed to check admin rights", zap.Error(err))
+		return
+	}
+	if !isAdmin {
+		b.reply(ctx, api, update.Message, "Менять настройки могут только админы")
+		return
+	}
+
+	switch args[1] {
+	case "on":
+		settings.Stickers = true
+	case "off":
+		settings.Stickers = false
+	default:
+		b.reply(ctx, api, update.Message, "Используй /stickers on или /stickers off")
+		return
+	}
+
+	err = b.store.SaveChatSettings(settings)
+	if err != nil {
+		b.logger.Error("failed to save chat settings", zap.Error(err))
+		return
+	}
+
+	if settings.Stickers {
+		b.reply(ctx, api, update.Message, "Проверка стикеров включена")
+	} else {
+		b.reply(ctx, api, update.Message, "Проверка стикеров выключена")
+	}
+}
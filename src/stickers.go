@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"github.com/go-faster/errors"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"github.com/sleroq/bayan/src/storage"
+)
+
+func stickerMedia(sticker *models.Sticker) storage.Media {
+	return storage.Media{
+		Kind:         storage.KindSticker,
+		FileUniqueID: sticker.FileUniqueID,
+	}
+}
+
+// stickerThumbnail is used for animated (TGS) stickers, which are gzipped
+// lottie animations and can't be decoded without a lottie renderer,
+// and for video stickers too short to take frames from.
+func stickerThumbnail(sticker *models.Sticker) *pictureFile {
+	if sticker.Thumbnail == nil {
+		return nil
+	}
+
+	pic := pictureFromPhoto(*sticker.Thumbnail)
+	pic.Media = stickerMedia(sticker)
+
+	return pic
+}
+
+func stickerVideo(sticker *models.Sticker) *videoFile {
+	return &videoFile{
+		FileID:    sticker.FileID,
+		FileSize:  int64(sticker.FileSize),
+		Thumbnail: sticker.Thumbnail,
+		Media:     stickerMedia(sticker),
+	}
+}
+
+func stickerPicture(sticker *models.Sticker) *pictureFile {
+	return &pictureFile{
+		FileID:   sticker.FileID,
+		MimeType: "image/webp",
+		Media:    stickerMedia(sticker),
+	}
+}
+
+func (b *BayanBot) processSticker(ctx context.Context, api *bot.Bot, msg *models.Message, sticker *models.Sticker) error {
+	settings, err := b.chatSettings(msg.Chat.ID)
+	if err != nil {
+		return errors.Wrap(err, "failed to get chat settings")
+	}
+
+	if !settings.Stickers {
+		return nil
+	}
+
+	switch {
+	case sticker.IsVideo:
+		err = b.processVideo(ctx, api, msg, stickerVideo(sticker))
+		if errors.Is(err, errNotEnoughFrames) && sticker.Thumbnail != nil {
+			err = b.processPicture(ctx, api, msg, stickerThumbnail(sticker))
+		}
+	case sticker.IsAnimated:
+		if sticker.Thumbnail == nil {
+			return nil
+		}
+		err = b.processPicture(ctx, api, msg, stickerThumbnail(sticker))
+	default:
+		err = b.processPicture(ctx, api, msg, stickerPicture(sticker))
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to process sticker")
+	}
+
+	return nil
+}
+
+func (b *BayanBot) compareSticker(ctx context.Context, api *bot.Bot, msg *models.Message, sticker *models.Sticker) error {
+	var err error
+	switch {
+	case sticker.IsVideo:
+		err = b.compareVideo(ctx, api, msg, stickerVideo(sticker))
+		if errors.Is(err, errNotEnoughFrames) && sticker.Thumbnail != nil {
+			err = b.comparePicture(ctx, api, msg, stickerThumbnail(sticker))
+		}
+	case sticker.IsAnimated:
+		if sticker.Thumbnail == nil {
+			return nil
+		}
+		err = b.comparePicture(ctx, api, msg, stickerThumbnail(sticker))
+	default:
+		err = b.comparePicture(ctx, api, msg, stickerPicture(sticker))
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to compare sticker")
+	}
+
+	return nil
+}
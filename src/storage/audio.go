@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"github.com/go-faster/errors"
+	"github.com/go-telegram/bot/models"
+)
+
+// AudioTrack is an acoustic fingerprint of a voice message, audio file or the sound of a video
+type AudioTrack struct {
+	// Duration is in seconds
+	Duration    int
+	Fingerprint []uint32
+}
+
+type MessageAudio struct {
+	Msg Message
+	AudioTrack
+}
+
+// execer is either the database or a transaction
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+func dumpFingerprint(fingerprint []uint32) ([]byte, error) {
+	var buf bytes.Buffer
+	err := binary.Write(&buf, binary.LittleEndian, fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func loadFingerprint(b []byte) ([]uint32, error) {
+	fingerprint := make([]uint32, len(b)/4)
+	err := binary.Read(bytes.NewReader(b), binary.LittleEndian, fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	return fingerprint, nil
+}
+
+func (s *Storage) SaveMessageAudio(msg *models.Message, media Media, track *AudioTrack) error {
+	return saveAudio(s.db, msg, media, track)
+}
+
+func saveAudio(db execer, msg *models.Message, media Media, track *AudioTrack) error {
+	dump, err := dumpFingerprint(track.Fingerprint)
+	if err != nil {
+		return errors.Wrap(err, "dumping fingerprint")
+	}
+
+	_, err = db.Exec(`
+		insert or ignore into audio (
+			id,
+			userId,
+			chatId,
+			sentDate,
+			kind,
+			fileUniqueId,
+			sha256,
+			duration,
+			fingerprint
+		) values (
+			:id,
+			:userId,
+			:chatId,
+			:sentDate,
+			:kind,
+			:fileUniqueId,
+			:sha256,
+			:duration,
+			:fingerprint
+		);`,
+		sql.Named("id", msg.ID),
+		sql.Named("userId", senderID(msg)),
+		sql.Named("chatId", msg.Chat.ID),
+		sql.Named("sentDate", msg.Date),
+		sql.Named("kind", media.Kind),
+		sql.Named("fileUniqueId", media.FileUniqueID),
+		sql.Named("sha256", media.SHA256),
+		sql.Named("duration", track.Duration),
+		sql.Named("fingerprint", dump),
+	)
+	if err != nil {
+		return errors.Wrap(err, "saving audio to database")
+	}
+
+	return nil
+}
+
+// FindMsgAudioFilter applies the filter to every acoustic fingerprint of the chat.
+// The filter returns the distance and whether the message is a match.
+// Matches are sorted like SortSimilar does, if limit is 0, all of them are returned.
+func (s *Storage) FindMsgAudioFilter(chatID int64, kind MediaKind, limit int, filter func(msg *MessageAudio) (dist int, ok bool, err error)) ([]*SimilarMessage, error) {
+	rows, err := s.db.Query(`
+		select
+			id,
+			userId,
+			chatId,
+			sentDate,
+			duration,
+			fingerprint
+		from audio
+		where chatId = :chatId
+		and kind = :kind
+		order by sentDate, id;
+	`, sql.Named("chatId", chatID), sql.Named("kind", kind))
+	if err != nil {
+		return nil, errors.Wrap(err, "querying audio")
+	}
+
+	return filterAudio(rows, limit, filter)
+}
+
+// filterAudio applies the filter to rows of id, userId, chatId, sentDate, duration and fingerprint
+func filterAudio(rows *sql.Rows, limit int, filter func(msg *MessageAudio) (dist int, ok bool, err error)) ([]*SimilarMessage, error) {
+	defer rows.Close()
+
+	var messages []*SimilarMessage
+	for rows.Next() {
+		var msg MessageAudio
+		var fingerprintBytes []byte
+		err := rows.Scan(
+			&msg.Msg.ID,
+			&msg.Msg.UserID,
+			&msg.Msg.ChatID,
+			&msg.Msg.SentDate,
+			&msg.Duration,
+			&fingerprintBytes,
+		)
+		if err != nil {
+			return nil, errors.Wrap(err, "scanning audio")
+		}
+
+		msg.Fingerprint, err = loadFingerprint(fingerprintBytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "loading fingerprint")
+		}
+
+		dist, ok, err := filter(&msg)
+		if err != nil {
+			return nil, errors.Wrap(err, "filtering audio")
+		}
+
+		if ok {
+			messages = append(messages, &SimilarMessage{
+				Msg: &Message{
+					ID:       msg.Msg.ID,
+					UserID:   msg.Msg.UserID,
+					ChatID:   msg.Msg.ChatID,
+					SentDate: msg.Msg.SentDate,
+				},
+				Distance: dist,
+			})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "reading audio")
+	}
+
+	SortSimilar(messages)
+	if limit != 0 && len(messages) > limit {
+		messages = messages[:limit]
+	}
+
+	return messages, nil
+}
+
+// GetAudioTrack returns the fingerprint of the message sound, or nil if it has none
+func (s *Storage) GetAudioTrack(chatID int64, id int) (*AudioTrack, error) {
+	var track AudioTrack
+	var fingerprintBytes []byte
+	err := s.db.QueryRow(`
+		select
+			duration,
+			fingerprint
+		from audio
+		where id = :id
+		and chatId = :chatId;
+	`, sql.Named("id", id), sql.Named("chatId", chatID)).Scan(
+		&track.Duration,
+		&fingerprintBytes,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "querying audio")
+	}
+
+	track.Fingerprint, err = loadFingerprint(fingerprintBytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading fingerprint")
+	}
+
+	return &track, nil
+}
@@ -0,0 +1,289 @@
+package storage
+
+import (
+	"database/sql"
+	"github.com/go-faster/errors"
+	"github.com/go-telegram/bot/models"
+	"strings"
+	"time"
+)
+
+// Copies of one meme are kept in the clusters table as a union-find forest.
+// Every member points straight at the root, which is the first posted member,
+// so a whole cluster is read with one query. Joining two clusters moves members
+// of the later root to the earlier one.
+
+// Cluster is every known copy of one meme in a chat
+type Cluster struct {
+	// Members are sorted by date, the first one is the original
+	Members []*ClusterMember
+}
+
+type ClusterMember struct {
+	Msg *Message
+	// UserName is empty for messages saved before clusters were added
+	UserName string
+}
+
+// Original returns the first posted copy
+func (c *Cluster) Original() *ClusterMember {
+	return c.Members[0]
+}
+
+// Before tells if the message was posted before the other one, on the same second the lower id is first
+func (m *Message) Before(other *Message) bool {
+	if !m.SentDate.Equal(other.SentDate) {
+		return m.SentDate.Before(other.SentDate)
+	}
+	return m.ID < other.ID
+}
+
+// posterName is the username of the sender, or the full name if there is none
+func posterName(user *models.User) string {
+	if user == nil {
+		return ""
+	}
+	if user.Username != "" {
+		return "@" + user.Username
+	}
+	return strings.TrimSpace(user.FirstName + " " + user.LastName)
+}
+
+// clusterNode returns the message to add to clusters and the name of its sender
+func clusterNode(msg *models.Message) (*Message, string) {
+	node := &Message{
+		ID:       msg.ID,
+		ChatID:   int(msg.Chat.ID),
+		SentDate: time.Unix(int64(msg.Date), 0).UTC(),
+	}
+	if msg.From != nil {
+		node.UserID = int(msg.From.ID)
+	}
+	return node, posterName(msg.From)
+}
+
+// earliestRoot returns the root the others are joined to
+func earliestRoot(roots []*Message) *Message {
+	earliest := roots[0]
+	for _, root := range roots[1:] {
+		if root.Before(earliest) {
+			earliest = root
+		}
+	}
+	return earliest
+}
+
+func scanCluster(rows *sql.Rows) (*Cluster, error) {
+	defer rows.Close()
+
+	var cluster Cluster
+	for rows.Next() {
+		var member ClusterMember
+		var msg Message
+		err := rows.Scan(
+			&msg.ID,
+			&msg.UserID,
+			&msg.ChatID,
+			&msg.SentDate,
+			&member.UserName,
+		)
+		if err != nil {
+			return nil, errors.Wrap(err, "scanning cluster member")
+		}
+
+		member.Msg = &msg
+		cluster.Members = append(cluster.Members, &member)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "reading cluster members")
+	}
+
+	if len(cluster.Members) == 0 {
+		return nil, nil
+	}
+
+	return &cluster, nil
+}
+
+// JoinCluster adds the message to the clusters of the similar messages, merging them into one
+func (s *Storage) JoinCluster(msg *models.Message, similar []*Message) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "beginning transaction")
+	}
+	defer tx.Rollback()
+
+	node, userName := clusterNode(msg)
+	err = s.addClusterNode(tx, node, userName)
+	if err != nil {
+		return err
+	}
+
+	// Messages saved before clusters were added have no node yet
+	for _, m := range similar {
+		err = s.addClusterNode(tx, m, "")
+		if err != nil {
+			return err
+		}
+	}
+
+	roots := make([]*Message, 0, len(similar)+1)
+	for _, m := range append([]*Message{node}, similar...) {
+		root, err := s.clusterRoot(tx, int64(m.ChatID), m.ID)
+		if err != nil {
+			return err
+		}
+		roots = append(roots, root)
+	}
+
+	earliest := earliestRoot(roots)
+	for _, root := range roots {
+		if root.ID == earliest.ID {
+			continue
+		}
+
+		_, err = tx.Exec(`
+			update clusters
+			set rootId = :rootId
+			where chatId = :chatId
+			and rootId = :oldRootId;`,
+			sql.Named("rootId", earliest.ID),
+			sql.Named("chatId", msg.Chat.ID),
+			sql.Named("oldRootId", root.ID),
+		)
+		if err != nil {
+			return errors.Wrap(err, "joining clusters")
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "committing transaction")
+	}
+
+	return nil
+}
+
+// addClusterNode adds the message as a cluster of its own, if it's not in a cluster yet
+func (s *Storage) addClusterNode(tx *sql.Tx, msg *Message, userName string) error {
+	_, err := tx.Exec(`
+		insert or ignore into clusters (
+			id,
+			userId,
+			userName,
+			chatId,
+			sentDate,
+			rootId
+		) values (
+			:id,
+			:userId,
+			:userName,
+			:chatId,
+			:sentDate,
+			:id
+		);`,
+		sql.Named("id", msg.ID),
+		sql.Named("userId", msg.UserID),
+		sql.Named("userName", userName),
+		sql.Named("chatId", msg.ChatID),
+		sql.Named("sentDate", msg.SentDate.Unix()),
+	)
+	if err != nil {
+		return errors.Wrap(err, "saving cluster node")
+	}
+
+	return nil
+}
+
+func (s *Storage) clusterRoot(tx *sql.Tx, chatID int64, id int) (*Message, error) {
+	var root Message
+	err := tx.QueryRow(`
+		select
+			r.id,
+			r.userId,
+			r.chatId,
+			r.sentDate
+		from clusters c
+		join clusters r on r.chatId = c.chatId and r.id = c.rootId
+		where c.chatId = :chatId
+		and c.id = :id;`,
+		sql.Named("chatId", chatID),
+		sql.Named("id", id),
+	).Scan(
+		&root.ID,
+		&root.UserID,
+		&root.ChatID,
+		&root.SentDate,
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "querying cluster root")
+	}
+
+	return &root, nil
+}
+
+// GetCluster returns the cluster of the message, or nil if it has no copies
+func (s *Storage) GetCluster(chatID int64, id int) (*Cluster, error) {
+	rows, err := s.db.Query(`
+		select
+			m.id,
+			m.userId,
+			m.chatId,
+			m.sentDate,
+			m.userName
+		from clusters c
+		join clusters m on m.chatId = c.chatId and m.rootId = c.rootId
+		where c.chatId = :chatId
+		and c.id = :id
+		order by m.sentDate, m.id;`,
+		sql.Named("chatId", chatID),
+		sql.Named("id", id),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "querying cluster")
+	}
+
+	cluster, err := scanCluster(rows)
+	if err != nil || cluster == nil || len(cluster.Members) < 2 {
+		return nil, err
+	}
+
+	return cluster, nil
+}
+
+// leaveCluster makes the next member the root, if the message is the root of its cluster
+func (s *Storage) leaveCluster(tx *sql.Tx, chatID int64, id int) error {
+	var next int
+	err := tx.QueryRow(`
+		select id
+		from clusters
+		where chatId = :chatId
+		and rootId = :id
+		and id != :id
+		order by sentDate, id
+		limit 1;`,
+		sql.Named("chatId", chatID),
+		sql.Named("id", id),
+	).Scan(&next)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "querying next cluster root")
+	}
+
+	_, err = tx.Exec(`
+		update clusters
+		set rootId = :next
+		where chatId = :chatId
+		and rootId = :id;`,
+		sql.Named("next", next),
+		sql.Named("chatId", chatID),
+		sql.Named("id", id),
+	)
+	if err != nil {
+		return errors.Wrap(err, "moving cluster root")
+	}
+
+	return nil
+}
@@ -0,0 +1,917 @@
+package storage
+
+import (
+	"github.com/corona10/goimagehash"
+	"github.com/go-faster/errors"
+	"github.com/go-telegram/bot/models"
+	"maps"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// testDatabaseURL is the environment variable with a PostgreSQL database to run the tests against,
+// without it only SQLite is tested
+const testDatabaseURL = "BAYAN_TEST_DATABASE_URL"
+
+func TestConformance(t *testing.T) {
+	for _, useIndex := range []bool{true, false} {
+		name := "sqlite"
+		if useIndex {
+			name = "sqlite with hash index"
+		}
+
+		t.Run(name, func(t *testing.T) {
+			store, err := New(filepath.Join(t.TempDir(), "bayan.db"), useIndex)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+
+			err = checkConformance(store)
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	t.Run("postgres", func(t *testing.T) {
+		url := os.Getenv(testDatabaseURL)
+		if url == "" {
+			t.Skipf("%s is not set", testDatabaseURL)
+		}
+
+		store, err := NewPostgres(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+
+		err = checkConformance(store)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// checkConformance saves messages to the store and checks that they are found the
+// way the bot expects, so every Store implementation behaves the same.
+// It uses two random chats and deletes them in the end, so it's safe to run against
+// a database the bot uses, but an empty database is better.
+func checkConformance(store Store) error {
+	chatID := -1000000000000 - rand.Int63n(1000000000)
+	otherChatID := chatID - 1
+
+	defer func() {
+		_ = store.DeleteChat(chatID)
+		_ = store.DeleteChat(otherChatID)
+	}()
+
+	checks := []struct {
+		name  string
+		check func(store Store, chatID, otherChatID int64) error
+	}{
+		{"pictures", checkPictures},
+		{"videos", checkVideos},
+		{"texts", checkTexts},
+		{"audio", checkAudio},
+		{"forwards", checkForwards},
+		{"links", checkLinks},
+		{"chat settings", checkChatSettings},
+		{"clusters", checkClusters},
+		{"detections", checkDetections},
+		{"reviews", checkReviews},
+		{"delete", checkDelete},
+	}
+
+	for _, c := range checks {
+		err := c.check(store, chatID, otherChatID)
+		if err != nil {
+			return errors.Wrap(err, c.name)
+		}
+	}
+
+	return nil
+}
+
+// conformanceDate is the date of the first test message, later ones are a minute apart
+var conformanceDate = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func conformanceMessage(chatID int64, id int) *models.Message {
+	return &models.Message{
+		ID:   id,
+		Chat: models.Chat{ID: chatID},
+		From: &models.User{ID: 1},
+		Date: int(conformanceDate.Add(time.Duration(id) * time.Minute).Unix()),
+	}
+}
+
+// expectFound checks ids and distances of found messages, in order
+func expectFound(what string, found []*SimilarMessage, err error, want ...[2]int) error {
+	if err != nil {
+		return errors.Wrap(err, what)
+	}
+
+	var got [][2]int
+	for _, msg := range found {
+		got = append(got, [2]int{msg.Msg.ID, msg.Distance})
+	}
+
+	if !slices.Equal(got, want) {
+		return errors.Errorf("%s: got [id distance] %v, want %v", what, got, want)
+	}
+
+	return nil
+}
+
+// expectVideos works like expectFound for videos
+func expectVideos(what string, found []*SimilarVideo, err error, want ...[2]int) error {
+	messages := make([]*SimilarMessage, len(found))
+	for i, video := range found {
+		messages[i] = &video.SimilarMessage
+	}
+	return expectFound(what, messages, err, want...)
+}
+
+// expectOne checks the id of a message found by an exact match, 0 means nothing should be found
+func expectOne(what string, found *SimilarMessage, err error, want int) error {
+	if err != nil {
+		return errors.Wrap(err, what)
+	}
+
+	got := 0
+	if found != nil {
+		got = found.Msg.ID
+	}
+
+	if got != want {
+		return errors.Errorf("%s: got message %d, want %d", what, got, want)
+	}
+
+	return nil
+}
+
+func pictureHash(hash uint64) *goimagehash.ImageHash {
+	return goimagehash.NewImageHash(hash, goimagehash.PHash)
+}
+
+func checkPictures(store Store, chatID, otherChatID int64) error {
+	const hash = uint64(0xF0F0F0F0F0F0F0F0)
+	const crop = uint64(0x0123456789ABCDEF)
+
+	saves := []struct {
+		id    int
+		media Media
+		hash  uint64
+		crops []uint64
+	}{
+		{1, Media{FileUniqueID: "file-1", SHA256: "sum-1"}, hash, []uint64{crop ^ 0b111, crop}},
+		{2, Media{FileUniqueID: "file-2"}, hash ^ 0b1, []uint64{crop ^ 0b1}},
+		{3, Media{FileUniqueID: "file-3"}, hash ^ 0xFF, nil},
+		{4, Media{Kind: KindSticker, FileUniqueID: "file-1"}, hash, []uint64{crop}},
+	}
+	for _, s := range saves {
+		err := store.SaveMessagePicture(conformanceMessage(chatID, s.id), s.media, pictureHash(s.hash), pictureHash(^s.hash), s.crops)
+		if err != nil {
+			return errors.Wrapf(err, "saving picture %d", s.id)
+		}
+	}
+
+	// Saving the same message again changes nothing
+	err := store.SaveMessagePicture(conformanceMessage(chatID, 1), Media{}, pictureHash(0), pictureHash(0), []uint64{0})
+	if err != nil {
+		return errors.Wrap(err, "saving picture again")
+	}
+
+	found, err := store.FindPicturesNear(chatID, KindRegular, HashPerception, hash, 10, 0)
+	if err = expectFound("all near", found, err, [2]int{1, 0}, [2]int{2, 1}, [2]int{3, 8}); err != nil {
+		return err
+	}
+
+	found, err = store.FindPicturesNear(chatID, KindRegular, HashPerception, hash, 8, 0)
+	if err = expectFound("threshold is exclusive", found, err, [2]int{1, 0}, [2]int{2, 1}); err != nil {
+		return err
+	}
+
+	found, err = store.FindPicturesNear(chatID, KindRegular, HashPerception, hash^0b1, 10, 1)
+	if err = expectFound("closest", found, err, [2]int{2, 0}); err != nil {
+		return err
+	}
+
+	found, err = store.FindPicturesNear(chatID, KindRegular, HashDifference, ^hash, 5, 0)
+	if err = expectFound("dHash", found, err, [2]int{1, 0}, [2]int{2, 1}); err != nil {
+		return err
+	}
+
+	found, err = store.FindPicturesNear(chatID, KindSticker, HashPerception, hash, 10, 0)
+	if err = expectFound("other kind", found, err, [2]int{4, 0}); err != nil {
+		return err
+	}
+
+	found, err = store.FindPicturesNear(otherChatID, KindRegular, HashPerception, hash, 10, 0)
+	if err = expectFound("other chat", found, err); err != nil {
+		return err
+	}
+
+	// Every picture is found once, by its closest crop
+	found, err = store.FindPicturesNear(chatID, KindRegular, HashCrop, crop, 5, 0)
+	if err = expectFound("crops", found, err, [2]int{1, 0}, [2]int{2, 1}); err != nil {
+		return err
+	}
+
+	found, err = store.FindPicturesNear(chatID, KindRegular, HashCrop, crop^0b11, 5, 1)
+	if err = expectFound("closest crop", found, err, [2]int{1, 1}); err != nil {
+		return err
+	}
+
+	found, err = store.FindPicturesNear(otherChatID, KindRegular, HashCrop, crop, 5, 0)
+	if err = expectFound("crops of other chat", found, err); err != nil {
+		return err
+	}
+
+	exact, err := store.FindMsgByFileUniqueID(chatID, KindRegular, "file-1")
+	if err = expectOne("file unique id", exact, err, 1); err != nil {
+		return err
+	}
+
+	exact, err = store.FindMsgBySHA256(chatID, KindRegular, "sum-1")
+	if err = expectOne("sha256", exact, err, 1); err != nil {
+		return err
+	}
+
+	exact, err = store.FindMsgBySHA256(chatID, KindRegular, "")
+	if err = expectOne("empty sha256", exact, err, 0); err != nil {
+		return err
+	}
+
+	err = store.SaveMessageCopy(conformanceMessage(chatID, 5), Media{FileUniqueID: "file-1"}, &Message{ID: 1, ChatID: int(chatID)})
+	if err != nil {
+		return errors.Wrap(err, "saving copy")
+	}
+
+	// Equally close messages are sorted by date, the original comes first
+	found, err = store.FindPicturesNear(chatID, KindRegular, HashPerception, hash, 1, 0)
+	if err = expectFound("copy", found, err, [2]int{1, 0}, [2]int{5, 0}); err != nil {
+		return err
+	}
+
+	found, err = store.FindPicturesNear(chatID, KindRegular, HashPerception, hash, 1, 1)
+	if err = expectFound("original of copies", found, err, [2]int{1, 0}); err != nil {
+		return err
+	}
+
+	found, err = store.FindPicturesNear(chatID, KindRegular, HashCrop, crop, 1, 0)
+	if err = expectFound("crops of copy", found, err, [2]int{1, 0}, [2]int{5, 0}); err != nil {
+		return err
+	}
+
+	exact, err = store.FindMsgBySHA256(chatID, KindRegular, "sum-1")
+	if err = expectOne("sha256 of copy", exact, err, 1); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// conformanceVideo has the frames as both pHashes and dHashes, they are shown step apart
+func conformanceVideo(frames []uint64, step time.Duration) *VideoHashes {
+	hashes := &VideoHashes{Duration: step * time.Duration(len(frames))}
+	for i, frame := range frames {
+		hashes.PHashes = append(hashes.PHashes, pictureHash(frame))
+		hashes.DHashes = append(hashes.DHashes, pictureHash(frame))
+		hashes.Times = append(hashes.Times, step*time.Duration(i))
+	}
+	return hashes
+}
+
+func checkVideos(store Store, chatID, otherChatID int64) error {
+	frames := []uint64{0x1111, 0x2222, 0x3333, 0x4444}
+	changed := slices.Clone(frames)
+	changed[1] ^= 0xF
+
+	track := &AudioTrack{Duration: 3, Fingerprint: []uint32{1, 2, 3, 4}}
+	err := store.SaveMessageVideo(conformanceMessage(chatID, 10), Media{}, conformanceVideo(frames, time.Second), track)
+	if err != nil {
+		return errors.Wrap(err, "saving video")
+	}
+
+	err = store.SaveMessageVideo(conformanceMessage(chatID, 11), Media{}, conformanceVideo(changed, time.Second), nil)
+	if err != nil {
+		return errors.Wrap(err, "saving video without sound")
+	}
+
+	videos, err := store.FindVideosNear(chatID, KindRegular, HashPerception, conformanceVideo(frames, time.Second), 2, 0)
+	if err = expectVideos("average distance", videos, err, [2]int{10, 0}, [2]int{11, 1}); err != nil {
+		return err
+	}
+
+	videos, err = store.FindVideosNear(chatID, KindRegular, HashDifference, conformanceVideo(changed, time.Second), 1, 0)
+	if err = expectVideos("dHash", videos, err, [2]int{11, 0}); err != nil {
+		return err
+	}
+
+	found, err := store.FindPicturesNear(chatID, KindRegular, HashPerception, frames[0], 1, 0)
+	if err = expectFound("videos are not pictures", found, err); err != nil {
+		return err
+	}
+
+	clip := []uint64{0x5555, 0x6666}
+	err = store.SaveMessageVideo(conformanceMessage(chatID, 13), Media{}, conformanceVideo(clip, 2*time.Second), nil)
+	if err != nil {
+		return errors.Wrap(err, "saving short video")
+	}
+
+	videos, err = store.FindVideosNear(chatID, KindRegular, HashPerception, conformanceVideo(clip, time.Second), 1, 0)
+	if err = expectVideos("sped up short video", videos, err, [2]int{13, 0}); err != nil {
+		return err
+	}
+
+	long := []uint64{0xFF, 0xFF00, 0xFF0000, 0xFF000000, 0xFF00000000, 0xFF0000000000, 0xFF000000000000, 0xFF00000000000000}
+	err = store.SaveMessageVideo(conformanceMessage(chatID, 14), Media{}, conformanceVideo(long, time.Second), nil)
+	if err != nil {
+		return errors.Wrap(err, "saving long video")
+	}
+
+	videos, err = store.FindVideosNear(chatID, KindRegular, HashPerception, conformanceVideo(long[2:6], time.Second), 1, 0)
+	if err = expectVideos("clip of long video", videos, err, [2]int{14, 0}); err != nil {
+		return err
+	}
+	want := VideoPart{From: 2 * time.Second, To: 6 * time.Second, Duration: 8 * time.Second}
+	if videos[0].Part == nil || *videos[0].Part != want {
+		return errors.Errorf("part of long video: got %+v, want %+v", videos[0].Part, want)
+	}
+
+	extended := append([]uint64{0x0F0F0F0F0F0F0F0F}, long...)
+	videos, err = store.FindVideosNear(chatID, KindRegular, HashPerception, conformanceVideo(extended, time.Second), 1, 0)
+	if err = expectVideos("long video with intro", videos, err, [2]int{14, 0}); err != nil {
+		return err
+	}
+	if videos[0].Part != nil {
+		return errors.Errorf("part of video with intro: got %+v, want the whole video", videos[0].Part)
+	}
+
+	// One frame is found in almost any long video, so it's compared with the whole video
+	err = store.SaveMessageVideo(conformanceMessage(otherChatID, 15), Media{}, conformanceVideo(long[3:4], time.Second), nil)
+	if err != nil {
+		return errors.Wrap(err, "saving one frame video")
+	}
+
+	videos, err = store.FindVideosNear(otherChatID, KindRegular, HashPerception, conformanceVideo(long, time.Second), 8, 0)
+	if err = expectVideos("one frame of long video", videos, err); err != nil {
+		return err
+	}
+
+	// The last frames of a video end together with it, but don't start with it
+	err = store.SaveMessageVideo(conformanceMessage(otherChatID, 16), Media{}, conformanceVideo(long[5:8], time.Second), nil)
+	if err != nil {
+		return errors.Wrap(err, "saving end of long video")
+	}
+
+	videos, err = store.FindVideosNear(otherChatID, KindRegular, HashPerception, conformanceVideo(long, time.Second), 8, 0)
+	if err = expectVideos("end of long video", videos, err); err != nil {
+		return err
+	}
+
+	got, err := store.GetAudioTrack(chatID, 10)
+	if err != nil {
+		return errors.Wrap(err, "getting audio track")
+	}
+	if got == nil || got.Duration != track.Duration || !slices.Equal(got.Fingerprint, track.Fingerprint) {
+		return errors.Errorf("audio track: got %+v, want %+v", got, track)
+	}
+
+	got, err = store.GetAudioTrack(chatID, 11)
+	if err != nil {
+		return errors.Wrap(err, "getting missing audio track")
+	}
+	if got != nil {
+		return errors.Errorf("audio track of video without sound: got %+v", got)
+	}
+
+	err = store.SaveMessageCopy(conformanceMessage(chatID, 12), Media{}, &Message{ID: 10, ChatID: int(chatID)})
+	if err != nil {
+		return errors.Wrap(err, "saving copy")
+	}
+
+	videos, err = store.FindVideosNear(chatID, KindRegular, HashPerception, conformanceVideo(frames, time.Second), 1, 0)
+	if err = expectVideos("copy", videos, err, [2]int{10, 0}, [2]int{12, 0}); err != nil {
+		return err
+	}
+
+	got, err = store.GetAudioTrack(chatID, 12)
+	if err != nil {
+		return errors.Wrap(err, "getting audio track of copy")
+	}
+	if got == nil || !slices.Equal(got.Fingerprint, track.Fingerprint) {
+		return errors.Errorf("audio track of copy: got %+v, want %+v", got, track)
+	}
+
+	return nil
+}
+
+func checkTexts(store Store, chatID, otherChatID int64) error {
+	const simHash = uint64(0xABCDEF)
+
+	err := store.SaveMessageText(conformanceMessage(chatID, 20), simHash)
+	if err != nil {
+		return errors.Wrap(err, "saving text")
+	}
+
+	found, err := store.FindTextsNear(chatID, simHash^0b11, 3, 0)
+	if err = expectFound("near", found, err, [2]int{20, 2}); err != nil {
+		return err
+	}
+
+	found, err = store.FindTextsNear(chatID, simHash^0b11, 2, 0)
+	if err = expectFound("far", found, err); err != nil {
+		return err
+	}
+
+	// A caption is saved with the media of the same message
+	err = store.SaveMessagePicture(conformanceMessage(chatID, 20), Media{}, pictureHash(simHash), pictureHash(simHash), nil)
+	if err != nil {
+		return errors.Wrap(err, "saving captioned picture")
+	}
+
+	found, err = store.FindTextsNear(chatID, simHash, 1, 0)
+	if err = expectFound("caption", found, err, [2]int{20, 0}); err != nil {
+		return err
+	}
+
+	found, err = store.FindPicturesNear(chatID, KindRegular, HashPerception, simHash, 1, 0)
+	if err = expectFound("captioned picture", found, err, [2]int{20, 0}); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func checkAudio(store Store, chatID, otherChatID int64) error {
+	fingerprint := []uint32{5, 6, 7}
+	err := store.SaveMessageAudio(conformanceMessage(chatID, 30), Media{Kind: KindAudio, FileUniqueID: "voice-1", SHA256: "voice-sum"}, &AudioTrack{Duration: 1, Fingerprint: fingerprint})
+	if err != nil {
+		return errors.Wrap(err, "saving audio")
+	}
+
+	err = store.SaveMessageAudio(conformanceMessage(chatID, 31), Media{Kind: KindAudio}, &AudioTrack{Duration: 1, Fingerprint: []uint32{8}})
+	if err != nil {
+		return errors.Wrap(err, "saving other audio")
+	}
+
+	found, err := store.FindMsgAudioFilter(chatID, KindAudio, 0, func(msg *MessageAudio) (dist int, ok bool, err error) {
+		return 0, slices.Equal(msg.Fingerprint, fingerprint), nil
+	})
+	if err = expectFound("filter", found, err, [2]int{30, 0}); err != nil {
+		return err
+	}
+
+	// The closest match is returned, not the first or the last one checked
+	found, err = store.FindMsgAudioFilter(chatID, KindAudio, 1, func(msg *MessageAudio) (dist int, ok bool, err error) {
+		return 40 - msg.Msg.ID, true, nil
+	})
+	if err = expectFound("closest", found, err, [2]int{31, 9}); err != nil {
+		return err
+	}
+
+	found, err = store.FindMsgAudioFilter(chatID, KindRegular, 0, func(msg *MessageAudio) (dist int, ok bool, err error) {
+		return 0, true, nil
+	})
+	// Sound of video 10 and its copy 12 from checkVideos
+	if err = expectFound("other kind", found, err, [2]int{10, 0}, [2]int{12, 0}); err != nil {
+		return err
+	}
+
+	// Voice messages and audio files are only in the audio table, they are found there
+	exact, err := store.FindMsgByFileUniqueID(chatID, KindAudio, "voice-1")
+	if err = expectOne("file unique id", exact, err, 30); err != nil {
+		return err
+	}
+
+	exact, err = store.FindMsgBySHA256(chatID, KindAudio, "voice-sum")
+	if err = expectOne("sha256", exact, err, 30); err != nil {
+		return err
+	}
+
+	err = store.SaveMessageCopy(conformanceMessage(chatID, 32), Media{Kind: KindAudio, FileUniqueID: "voice-1"}, &Message{ID: 30, ChatID: int(chatID)})
+	if err != nil {
+		return errors.Wrap(err, "saving copy")
+	}
+
+	got, err := store.GetAudioTrack(chatID, 32)
+	if err != nil {
+		return errors.Wrap(err, "getting audio track of copy")
+	}
+	if got == nil || !slices.Equal(got.Fingerprint, fingerprint) {
+		return errors.Errorf("audio track of copy: got %+v, want %v", got, fingerprint)
+	}
+
+	exact, err = store.FindMsgBySHA256(chatID, KindAudio, "voice-sum")
+	if err = expectOne("sha256 of copy", exact, err, 30); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func checkForwards(store Store, chatID, otherChatID int64) error {
+	origin := &ForwardOrigin{Key: "channel:1/1", Date: conformanceDate}
+
+	// The later message is saved first, the first one should still be found
+	for _, id := range []int{41, 40} {
+		err := store.SaveForward(conformanceMessage(chatID, id), origin)
+		if err != nil {
+			return errors.Wrapf(err, "saving forward %d", id)
+		}
+	}
+
+	found, err := store.FindForward(chatID, origin.Key)
+	if err = expectOne("first forward", found, err, 40); err != nil {
+		return err
+	}
+
+	found, err = store.FindForward(otherChatID, origin.Key)
+	if err = expectOne("other chat", found, err, 0); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func checkLinks(store Store, chatID, otherChatID int64) error {
+	err := store.SaveLinks(conformanceMessage(chatID, 51), []string{"b"})
+	if err != nil {
+		return errors.Wrap(err, "saving links")
+	}
+
+	err = store.SaveLinks(conformanceMessage(chatID, 50), []string{"a", "b"})
+	if err != nil {
+		return errors.Wrap(err, "saving links")
+	}
+
+	found, err := store.FindLink(chatID, "b")
+	if err = expectOne("first link", found, err, 50); err != nil {
+		return err
+	}
+
+	found, err = store.FindLink(chatID, "c")
+	if err = expectOne("missing link", found, err, 0); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func checkChatSettings(store Store, chatID, otherChatID int64) error {
+	settings, err := store.GetChatSettings(otherChatID)
+	if err != nil {
+		return errors.Wrap(err, "getting missing settings")
+	}
+	if settings != nil {
+		return errors.Errorf("missing settings: got %+v", settings)
+	}
+
+	thresholds, err := store.GetChatThresholds(chatID)
+	if err != nil {
+		return errors.Wrap(err, "getting missing thresholds")
+	}
+	if len(thresholds) != 0 {
+		return errors.Errorf("missing thresholds: got %v", thresholds)
+	}
+
+	for _, change := range []struct {
+		media     string
+		threshold int
+		want      map[string]int
+	}{
+		{"photo", 8, map[string]int{"photo": 8}},
+		{"audio", 25, map[string]int{"photo": 8, "audio": 25}},
+		{"photo", 12, map[string]int{"photo": 12, "audio": 25}},
+		{"photo", 0, map[string]int{"audio": 25}},
+	} {
+		err = store.SaveChatThreshold(chatID, change.media, change.threshold)
+		if err != nil {
+			return errors.Wrap(err, "saving threshold")
+		}
+
+		thresholds, err = store.GetChatThresholds(chatID)
+		if err != nil {
+			return errors.Wrap(err, "getting thresholds")
+		}
+		if !maps.Equal(thresholds, change.want) {
+			return errors.Errorf("thresholds: got %v, want %v", thresholds, change.want)
+		}
+	}
+
+	for _, stickers := range []bool{true, false} {
+		err = store.SaveChatSettings(&ChatSettings{ChatID: chatID, Stickers: stickers})
+		if err != nil {
+			return errors.Wrap(err, "saving settings")
+		}
+
+		settings, err = store.GetChatSettings(chatID)
+		if err != nil {
+			return errors.Wrap(err, "getting settings")
+		}
+		if settings == nil || settings.Stickers != stickers {
+			return errors.Errorf("settings: got %+v, want stickers %v", settings, stickers)
+		}
+	}
+
+	return nil
+}
+
+// expectCluster checks ids of cluster members, the original first, no ids means no cluster
+func expectCluster(what string, cluster *Cluster, err error, want ...int) error {
+	if err != nil {
+		return errors.Wrap(err, what)
+	}
+
+	var got []int
+	if cluster != nil {
+		for _, member := range cluster.Members {
+			got = append(got, member.Msg.ID)
+		}
+	}
+
+	if !slices.Equal(got, want) {
+		return errors.Errorf("%s: got members %v, want %v", what, got, want)
+	}
+
+	return nil
+}
+
+func checkClusters(store Store, chatID, otherChatID int64) error {
+	node := func(id int) *Message {
+		msg, _ := clusterNode(conformanceMessage(chatID, id))
+		return msg
+	}
+
+	// 60 and 61 are one meme, 62 and 63 another one, until 64 is similar to both
+	joins := []struct {
+		id      int
+		similar []*Message
+	}{
+		{61, []*Message{node(60)}},
+		{63, nil},
+		{62, []*Message{node(63)}},
+	}
+	for _, j := range joins {
+		err := store.JoinCluster(conformanceMessage(chatID, j.id), j.similar)
+		if err != nil {
+			return errors.Wrapf(err, "joining %d", j.id)
+		}
+	}
+
+	cluster, err := store.GetCluster(chatID, 60)
+	if err = expectCluster("first", cluster, err, 60, 61); err != nil {
+		return err
+	}
+
+	// The root is the first posted message, even if it joined later
+	cluster, err = store.GetCluster(chatID, 63)
+	if err = expectCluster("second", cluster, err, 62, 63); err != nil {
+		return err
+	}
+
+	msg := conformanceMessage(chatID, 64)
+	msg.From.Username = "poster"
+	err = store.JoinCluster(msg, []*Message{node(61), node(63)})
+	if err != nil {
+		return errors.Wrap(err, "joining clusters")
+	}
+
+	cluster, err = store.GetCluster(chatID, 62)
+	if err = expectCluster("merged", cluster, err, 60, 61, 62, 63, 64); err != nil {
+		return err
+	}
+
+	if name := cluster.Members[4].UserName; name != "@poster" {
+		return errors.Errorf("user name: got %q, want %q", name, "@poster")
+	}
+
+	cluster, err = store.GetCluster(chatID, 65)
+	if err = expectCluster("missing", cluster, err); err != nil {
+		return err
+	}
+
+	err = store.DeleteMessage(chatID, 60)
+	if err != nil {
+		return errors.Wrap(err, "deleting original")
+	}
+
+	cluster, err = store.GetCluster(chatID, 64)
+	if err = expectCluster("deleted original", cluster, err, 61, 62, 63, 64); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func checkDetections(store Store, chatID, otherChatID int64) error {
+	saves := []struct {
+		matchID, distance int
+		nearMiss          bool
+	}{
+		{70, 3, false},
+		{71, 5, false},
+		{73, 12, true},
+	}
+	msg := conformanceMessage(chatID, 72)
+	for _, s := range saves {
+		match, _ := clusterNode(conformanceMessage(chatID, s.matchID))
+		err := store.SaveDetection(msg, match, KindSticker, AlgorithmPHash, s.distance, 10, s.nearMiss)
+		if err != nil {
+			return errors.Wrapf(err, "saving detection of %d", s.matchID)
+		}
+	}
+
+	hourAgo := time.Now().Add(-time.Hour)
+	detections, err := store.GetDetections(chatID, hourAgo, 0)
+	if err != nil {
+		return errors.Wrap(err, "getting detections")
+	}
+	if len(detections) != 3 {
+		return errors.Errorf("detections: got %d, want 3", len(detections))
+	}
+
+	detections, err = store.GetDetections(chatID, time.Now().Add(time.Hour), 0)
+	if err != nil {
+		return errors.Wrap(err, "getting future detections")
+	}
+	if len(detections) != 0 {
+		return errors.Errorf("future detections: got %d, want 0", len(detections))
+	}
+
+	detections, err = store.GetMessageDetections(chatID, 70)
+	if err != nil {
+		return errors.Wrap(err, "getting message detections")
+	}
+	want := Detection{ChatID: chatID, ID: 72, MatchID: 70, Kind: KindSticker, Algorithm: AlgorithmPHash, Distance: 3, Threshold: 10}
+	if len(detections) != 1 {
+		return errors.Errorf("message detections: got %d, want 1", len(detections))
+	}
+	got := *detections[0]
+	if got.DetectedAt.Before(hourAgo) {
+		return errors.Errorf("detection date: got %v", got.DetectedAt)
+	}
+	got.DetectedAt = time.Time{}
+	if got != want {
+		return errors.Errorf("message detection: got %+v, want %+v", got, want)
+	}
+
+	counts, err := store.CountDetections(chatID, hourAgo)
+	if err != nil {
+		return errors.Wrap(err, "counting detections")
+	}
+	wantCount := DetectionCount{Kind: KindSticker, Algorithm: AlgorithmPHash, Matches: 2, NearMisses: 1}
+	if len(counts) != 1 || *counts[0] != wantCount {
+		return errors.Errorf("detection counts: got %v, want %+v", counts, wantCount)
+	}
+
+	err = store.DeleteMessage(chatID, 70)
+	if err != nil {
+		return errors.Wrap(err, "deleting matched message")
+	}
+
+	detections, err = store.GetMessageDetections(chatID, 72)
+	if err != nil {
+		return errors.Wrap(err, "getting message detections")
+	}
+	if len(detections) != 2 {
+		return errors.Errorf("detections of deleted match: got %d, want 2", len(detections))
+	}
+
+	return nil
+}
+
+func checkReviews(store Store, chatID, otherChatID int64) error {
+	msg := conformanceMessage(chatID, 82)
+	msg.From.Username = "poster"
+	saves := []struct {
+		msg            *models.Message
+		matchID, score int
+	}{
+		{msg, 80, 30},
+		{msg, 81, 40},
+		{conformanceMessage(chatID, 83), 80, 35},
+	}
+	for _, s := range saves {
+		match, _ := clusterNode(conformanceMessage(chatID, s.matchID))
+		err := store.SaveReview(s.msg, match, KindRegular, AlgorithmPHash, 12, 10, s.score)
+		if err != nil {
+			return errors.Wrapf(err, "saving review of %d", s.matchID)
+		}
+	}
+
+	reviews, err := store.GetReviews(chatID, 0)
+	if err != nil {
+		return errors.Wrap(err, "getting reviews")
+	}
+	if len(reviews) != 3 {
+		return errors.Errorf("reviews: got %d, want 3", len(reviews))
+	}
+
+	reviews, err = store.GetMessageReviews(chatID, 82)
+	if err != nil {
+		return errors.Wrap(err, "getting message reviews")
+	}
+	if len(reviews) != 2 || reviews[0].Match.ID != 81 || reviews[1].Match.ID != 80 {
+		return errors.Errorf("message reviews: got %d, want 81 and 80", len(reviews))
+	}
+	got := reviews[0]
+	wantMsg, _ := clusterNode(msg)
+	if *got.Msg != *wantMsg || got.UserName != "@poster" {
+		return errors.Errorf("reviewed message: got %+v by %q, want %+v by @poster", got.Msg, got.UserName, wantMsg)
+	}
+	if got.CreatedAt.Before(time.Now().Add(-time.Hour)) {
+		return errors.Errorf("review date: got %v", got.CreatedAt)
+	}
+	wantMatch, _ := clusterNode(conformanceMessage(chatID, 81))
+	if *got.Match != *wantMatch {
+		return errors.Errorf("review match: got %+v, want %+v", got.Match, wantMatch)
+	}
+	if got.Kind != KindRegular || got.Algorithm != AlgorithmPHash || got.Distance != 12 || got.Threshold != 10 || got.Score != 40 {
+		return errors.Errorf("review comparison: got %+v", got)
+	}
+
+	err = store.DeleteReviews(chatID, 82)
+	if err != nil {
+		return errors.Wrap(err, "deleting reviews")
+	}
+
+	reviews, err = store.GetMessageReviews(chatID, 82)
+	if err != nil {
+		return errors.Wrap(err, "getting deleted reviews")
+	}
+	if len(reviews) != 0 {
+		return errors.Errorf("deleted reviews: got %d, want 0", len(reviews))
+	}
+
+	err = store.DeleteMessage(chatID, 80)
+	if err != nil {
+		return errors.Wrap(err, "deleting matched message")
+	}
+
+	reviews, err = store.GetReviews(chatID, 0)
+	if err != nil {
+		return errors.Wrap(err, "getting reviews")
+	}
+	if len(reviews) != 0 {
+		return errors.Errorf("reviews of deleted match: got %d, want 0", len(reviews))
+	}
+
+	return nil
+}
+
+func checkDelete(store Store, chatID, otherChatID int64) error {
+	err := store.DeleteMessage(chatID, 5)
+	if err != nil {
+		return errors.Wrap(err, "deleting message")
+	}
+
+	found, err := store.FindPicturesNear(chatID, KindRegular, HashPerception, 0xF0F0F0F0F0F0F0F0, 1, 0)
+	if err = expectFound("deleted picture", found, err, [2]int{1, 0}); err != nil {
+		return err
+	}
+
+	found, err = store.FindPicturesNear(chatID, KindRegular, HashCrop, 0x0123456789ABCDEF, 1, 0)
+	if err = expectFound("crops of deleted picture", found, err, [2]int{1, 0}); err != nil {
+		return err
+	}
+
+	exact, err := store.FindMsgBySHA256(chatID, KindRegular, "sum-1")
+	if err = expectOne("sha256 of deleted copy", exact, err, 1); err != nil {
+		return err
+	}
+
+	err = store.DeleteChat(chatID)
+	if err != nil {
+		return errors.Wrap(err, "deleting chat")
+	}
+
+	found, err = store.FindPicturesNear(chatID, KindRegular, HashPerception, 0xF0F0F0F0F0F0F0F0, 64, 0)
+	if err = expectFound("deleted chat", found, err); err != nil {
+		return err
+	}
+
+	settings, err := store.GetChatSettings(chatID)
+	if err != nil {
+		return errors.Wrap(err, "getting settings of deleted chat")
+	}
+	if settings != nil {
+		return errors.Errorf("settings of deleted chat: got %+v", settings)
+	}
+
+	thresholds, err := store.GetChatThresholds(chatID)
+	if err != nil {
+		return errors.Wrap(err, "getting thresholds of deleted chat")
+	}
+	if len(thresholds) != 0 {
+		return errors.Errorf("thresholds of deleted chat: got %v", thresholds)
+	}
+
+	return nil
+}
@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"database/sql"
+	"github.com/go-faster/errors"
+)
+
+func saveCrops(db execer, chatID int64, id int, crops []uint64) error {
+	for crop, hash := range crops {
+		_, err := db.Exec(`
+			insert or ignore into picture_crops (
+				id,
+				chatId,
+				crop,
+				pHash
+			) values (
+				:id,
+				:chatId,
+				:crop,
+				:pHash
+			);`,
+			sql.Named("id", id),
+			sql.Named("chatId", chatID),
+			sql.Named("crop", crop),
+			sql.Named("pHash", int64(hash)),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// findCropsSQL finds pictures with any crop closer than threshold, the distance is of the closest crop
+func (s *Storage) findCropsSQL(chatID int64, kind MediaKind, hash uint64, threshold, limit int) ([]*SimilarMessage, error) {
+	rows, err := s.db.Query(`
+		select
+			m.id,
+			m.userId,
+			m.chatId,
+			m.sentDate,
+			min(hamming(c.pHash, :hash)) as distance
+		from picture_crops c
+		join messages m on m.id = c.id and m.chatId = c.chatId
+		where c.chatId = :chatId
+		and m.isVideo = 0
+		and m.kind = :kind
+		and hamming(c.pHash, :hash) < :threshold
+		group by m.id, m.chatId
+		order by distance, m.sentDate, m.id
+		limit :limit;`,
+		sql.Named("chatId", chatID),
+		sql.Named("kind", kind),
+		sql.Named("hash", int64(hash)),
+		sql.Named("threshold", threshold),
+		sql.Named("limit", sqlLimit(limit)),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "querying crops")
+	}
+
+	return scanSimilar(rows)
+}
+
+// closestPerMessage keeps the closest match of every message, the index has a match for every crop.
+// messages must be sorted by SortSimilar.
+func closestPerMessage(messages []*SimilarMessage, limit int) []*SimilarMessage {
+	seen := make(map[int]bool)
+	closest := messages[:0]
+	for _, m := range messages {
+		if seen[m.Msg.ID] {
+			continue
+		}
+		seen[m.Msg.ID] = true
+		closest = append(closest, m)
+	}
+
+	if limit != 0 && len(closest) > limit {
+		closest = closest[:limit]
+	}
+
+	return closest
+}
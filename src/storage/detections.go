@@ -0,0 +1,227 @@
+package storage
+
+import (
+	"database/sql"
+	"github.com/go-faster/errors"
+	"github.com/go-telegram/bot/models"
+	"time"
+)
+
+// Algorithm is the comparison a match was found by
+type Algorithm string
+
+const (
+	AlgorithmFileUniqueID Algorithm = "fileUniqueId"
+	AlgorithmSHA256       Algorithm = "sha256"
+	AlgorithmPHash        Algorithm = "pHash"
+	AlgorithmDHash        Algorithm = "dHash"
+	// AlgorithmCrop is the pHash of a center crop compared with the pHash of a whole picture
+	AlgorithmCrop       Algorithm = "pHashCrop"
+	AlgorithmVideoPHash Algorithm = "videoPHash"
+	AlgorithmVideoDHash Algorithm = "videoDHash"
+	// AlgorithmVideoAudio is frame hashes combined with the sound of both videos
+	AlgorithmVideoAudio Algorithm = "videoAudio"
+	AlgorithmSimHash    Algorithm = "simHash"
+	AlgorithmAudio      Algorithm = "audio"
+	AlgorithmForward    Algorithm = "forward"
+	AlgorithmLink       Algorithm = "link"
+)
+
+// Detection is a saved comparison of a new message with an older one
+type Detection struct {
+	ChatID int64
+	// ID is the new message, MatchID is the older message it was compared with
+	ID        int
+	MatchID   int
+	Kind      MediaKind
+	Algorithm Algorithm
+	Distance  int
+	Threshold int
+	// NearMiss is set when the distance was close to the threshold, but not under it
+	NearMiss   bool
+	DetectedAt time.Time
+}
+
+// DetectionCount is the number of detections of one kind found by one algorithm
+type DetectionCount struct {
+	Kind       MediaKind
+	Algorithm  Algorithm
+	Matches    int
+	NearMisses int
+}
+
+// SaveDetection saves a comparison of the message with the matched one
+func (s *Storage) SaveDetection(msg *models.Message, match *Message, kind MediaKind, algorithm Algorithm, distance, threshold int, nearMiss bool) error {
+	_, err := s.db.Exec(`
+		insert or ignore into detections (
+			id,
+			chatId,
+			matchId,
+			kind,
+			algorithm,
+			distance,
+			threshold,
+			nearMiss,
+			detectedAt
+		) values (
+			:id,
+			:chatId,
+			:matchId,
+			:kind,
+			:algorithm,
+			:distance,
+			:threshold,
+			:nearMiss,
+			:detectedAt
+		);`,
+		sql.Named("id", msg.ID),
+		sql.Named("chatId", msg.Chat.ID),
+		sql.Named("matchId", match.ID),
+		sql.Named("kind", kind),
+		sql.Named("algorithm", algorithm),
+		sql.Named("distance", distance),
+		sql.Named("threshold", threshold),
+		sql.Named("nearMiss", nearMiss),
+		sql.Named("detectedAt", time.Now().UTC().Unix()),
+	)
+	if err != nil {
+		return errors.Wrap(err, "saving detection to database")
+	}
+
+	return nil
+}
+
+func scanDetections(rows *sql.Rows) ([]*Detection, error) {
+	defer rows.Close()
+
+	var detections []*Detection
+	for rows.Next() {
+		var d Detection
+		err := rows.Scan(
+			&d.ID,
+			&d.ChatID,
+			&d.MatchID,
+			&d.Kind,
+			&d.Algorithm,
+			&d.Distance,
+			&d.Threshold,
+			&d.NearMiss,
+			&d.DetectedAt,
+		)
+		if err != nil {
+			return nil, errors.Wrap(err, "scanning detection")
+		}
+
+		detections = append(detections, &d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "reading detections")
+	}
+
+	return detections, nil
+}
+
+// GetDetections returns detections in the chat since the given time, newest first.
+// If limit is 0, all of them are returned.
+func (s *Storage) GetDetections(chatID int64, since time.Time, limit int) ([]*Detection, error) {
+	rows, err := s.db.Query(`
+		select
+			id,
+			chatId,
+			matchId,
+			kind,
+			algorithm,
+			distance,
+			threshold,
+			nearMiss,
+			detectedAt
+		from detections
+		where chatId = :chatId
+		and detectedAt >= :since
+		order by detectedAt desc, id desc
+		limit :limit;`,
+		sql.Named("chatId", chatID),
+		sql.Named("since", since.Unix()),
+		sql.Named("limit", sqlLimit(limit)),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "querying detections")
+	}
+
+	return scanDetections(rows)
+}
+
+// GetMessageDetections returns detections where the message is either the new or the matched one
+func (s *Storage) GetMessageDetections(chatID int64, id int) ([]*Detection, error) {
+	rows, err := s.db.Query(`
+		select
+			id,
+			chatId,
+			matchId,
+			kind,
+			algorithm,
+			distance,
+			threshold,
+			nearMiss,
+			detectedAt
+		from detections
+		where chatId = :chatId
+		and (id = :id or matchId = :id)
+		order by detectedAt, id, matchId;`,
+		sql.Named("chatId", chatID),
+		sql.Named("id", id),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "querying detections")
+	}
+
+	return scanDetections(rows)
+}
+
+// CountDetections counts detections in the chat since the given time by kind and algorithm
+func (s *Storage) CountDetections(chatID int64, since time.Time) ([]*DetectionCount, error) {
+	rows, err := s.db.Query(`
+		select
+			kind,
+			algorithm,
+			sum(case when nearMiss then 0 else 1 end),
+			sum(case when nearMiss then 1 else 0 end)
+		from detections
+		where chatId = :chatId
+		and detectedAt >= :since
+		group by kind, algorithm
+		order by kind, algorithm;`,
+		sql.Named("chatId", chatID),
+		sql.Named("since", since.Unix()),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "querying detections")
+	}
+
+	return scanDetectionCounts(rows)
+}
+
+func scanDetectionCounts(rows *sql.Rows) ([]*DetectionCount, error) {
+	defer rows.Close()
+
+	var counts []*DetectionCount
+	for rows.Next() {
+		var c DetectionCount
+		err := rows.Scan(
+			&c.Kind,
+			&c.Algorithm,
+			&c.Matches,
+			&c.NearMisses,
+		)
+		if err != nil {
+			return nil, errors.Wrap(err, "scanning detection count")
+		}
+
+		counts = append(counts, &c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "reading detection counts")
+	}
+
+	return counts, nil
+}
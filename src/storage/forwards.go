@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"database/sql"
+	"github.com/go-faster/errors"
+	"github.com/go-telegram/bot/models"
+	"time"
+)
+
+// ForwardOrigin identifies the message a forward was made from
+type ForwardOrigin struct {
+	// Key is the same for all forwards of one original message
+	Key string
+	// Date is when the original message was posted
+	Date time.Time
+}
+
+func (s *Storage) SaveForward(msg *models.Message, origin *ForwardOrigin) error {
+	_, err := s.db.Exec(`
+		insert or ignore into forwards (
+			id,
+			userId,
+			chatId,
+			sentDate,
+			originKey,
+			originDate
+		) values (
+			:id,
+			:userId,
+			:chatId,
+			:sentDate,
+			:originKey,
+			:originDate
+		);`,
+		sql.Named("id", msg.ID),
+		sql.Named("userId", senderID(msg)),
+		sql.Named("chatId", msg.Chat.ID),
+		sql.Named("sentDate", msg.Date),
+		sql.Named("originKey", origin.Key),
+		sql.Named("originDate", origin.Date),
+	)
+	if err != nil {
+		return errors.Wrap(err, "saving forward to database")
+	}
+
+	return nil
+}
+
+// FindForward finds the first message in the chat forwarded from the same original.
+// Returns nil if there is no such message.
+func (s *Storage) FindForward(chatID int64, originKey string) (*SimilarMessage, error) {
+	var msg Message
+	err := s.db.QueryRow(`
+		select
+			id,
+			userId,
+			chatId,
+			sentDate
+		from forwards
+		where chatId = :chatId
+		and originKey = :originKey
+		order by sentDate, id
+		limit 1;
+	`,
+		sql.Named("chatId", chatID),
+		sql.Named("originKey", originKey),
+	).Scan(
+		&msg.ID,
+		&msg.UserID,
+		&msg.ChatID,
+		&msg.SentDate,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "querying forward")
+	}
+
+	return &SimilarMessage{Msg: &msg, Distance: 0}, nil
+}
@@ -0,0 +1,279 @@
+package storage
+
+import (
+	"database/sql"
+	"github.com/go-faster/errors"
+	"math/bits"
+	"sort"
+	"time"
+)
+
+const (
+	// wholePartShare is how much of a video, in percents, a match has to cover to count as the whole video
+	wholePartShare = 90
+	// minPartFrames is how many frames a video needs to be matched to a part of a longer one,
+	// a frame or two of a video is found in almost any long video
+	minPartFrames = 4
+	// minPartShare is how much of the longer video, in percents, the shorter one has to last
+	// to be matched to a part of it
+	minPartShare = 10
+)
+
+// frameSequence is a video as it is compared: hashes of its frames in order
+// and when they are shown, in milliseconds
+type frameSequence struct {
+	pHashes, dHashes []uint64
+	times            []int
+	// duration is 0 for videos saved before it was known
+	duration int
+}
+
+func (h *VideoHashes) sequence() *frameSequence {
+	seq := &frameSequence{
+		pHashes:  make([]uint64, len(h.PHashes)),
+		dHashes:  make([]uint64, len(h.DHashes)),
+		times:    make([]int, len(h.Times)),
+		duration: int(h.Duration.Milliseconds()),
+	}
+	for i, hash := range h.PHashes {
+		seq.pHashes[i] = hash.GetHash()
+	}
+	for i, hash := range h.DHashes {
+		seq.dHashes[i] = hash.GetHash()
+	}
+	for i, t := range h.Times {
+		seq.times[i] = int(t.Milliseconds())
+	}
+	return seq
+}
+
+func (s *frameSequence) hashes(hashType HashType) []uint64 {
+	if hashType == HashDifference {
+		return s.dHashes
+	}
+	return s.pHashes
+}
+
+// alignment is the best match of every frame of a video to frames of another one
+type alignment struct {
+	// distance is the average distance of matched frames
+	distance int
+	// first and last are the frames of the other video the match starts and ends on
+	first, last int
+}
+
+// alignFrames matches every frame of short, in order, to frames of long with dynamic time warping.
+// A frame can be matched to several frames of the other video, so a sped up or slowed down copy matches.
+// With open, the match can start and end anywhere in long, so a clip cut from a video, or a video
+// with an intro or outro added, still matches. Otherwise the whole videos are matched end to end.
+func alignFrames(short, long []uint64, open bool) alignment {
+	type cell struct {
+		// sum is the distance of matched frames, steps is how many pairs were matched
+		sum, steps int
+		first      int
+		// reached is false for cells no match gets to
+		reached bool
+	}
+
+	prev := make([]cell, len(long))
+	cur := make([]cell, len(long))
+	for i, hash := range short {
+		for j, other := range long {
+			dist := bits.OnesCount64(hash ^ other)
+			var best cell
+			var previous []cell
+			if i == 0 {
+				// In an open match the first frame can be matched anywhere, earlier frames of long are skipped
+				if open || j == 0 {
+					best = cell{first: j, reached: true}
+				}
+			} else {
+				best = prev[j]
+				if j > 0 {
+					previous = append(previous, prev[j-1])
+				}
+			}
+			if j > 0 {
+				previous = append(previous, cur[j-1])
+			}
+
+			for _, c := range previous {
+				// On ties the match that starts earlier covers more of long
+				if c.reached && (!best.reached || c.sum < best.sum || c.sum == best.sum && c.first < best.first) {
+					best = c
+				}
+			}
+
+			cur[j] = cell{}
+			if best.reached {
+				cur[j] = cell{sum: best.sum + dist, steps: best.steps + 1, first: best.first, reached: true}
+			}
+		}
+		prev, cur = cur, prev
+	}
+
+	// The last frame can be matched anywhere too in an open match, later frames of long are skipped
+	best := alignment{distance: -1}
+	for j, c := range prev {
+		if !c.reached || !open && j < len(prev)-1 {
+			continue
+		}
+		if dist := c.sum / c.steps; best.distance < 0 || dist <= best.distance {
+			best = alignment{distance: dist, first: c.first, last: j}
+		}
+	}
+
+	return best
+}
+
+// part returns the part of the video shown from the first frame to the end of the last one.
+// It's nil if the part is most of the video, or times of frames are not known.
+func (s *frameSequence) part(first, last int) *VideoPart {
+	if s.duration == 0 || len(s.times) != len(s.pHashes) {
+		return nil
+	}
+
+	part := &VideoPart{From: time.Duration(s.times[first]) * time.Millisecond, Duration: time.Duration(s.duration) * time.Millisecond}
+	part.To = part.Duration
+	if last+1 < len(s.times) {
+		part.To = time.Duration(s.times[last+1]) * time.Millisecond
+	}
+
+	if (part.To-part.From)*100 >= part.Duration*wholePartShare {
+		return nil
+	}
+	return part
+}
+
+// partOf reports whether the video is long enough to be matched to a part of the longer one
+func (s *frameSequence) partOf(longer *frameSequence) bool {
+	if len(s.pHashes) < minPartFrames {
+		return false
+	}
+	if s.duration == 0 || longer.duration == 0 {
+		return len(s.pHashes)*100 >= len(longer.pHashes)*minPartShare
+	}
+	return s.duration*100 >= longer.duration*minPartShare
+}
+
+// compareSequences aligns the video with fewer frames to the other one. If the new video
+// is the shorter one, the part of the stored video it covers is returned too.
+func compareSequences(video, stored *frameSequence, hashType HashType) (int, *VideoPart) {
+	hashes, storedHashes := video.hashes(hashType), stored.hashes(hashType)
+	if len(hashes) == 0 || len(storedHashes) == 0 {
+		return 0, nil
+	}
+
+	if len(hashes) > len(storedHashes) {
+		return alignFrames(storedHashes, hashes, stored.partOf(video)).distance, nil
+	}
+
+	match := alignFrames(hashes, storedHashes, video.partOf(stored))
+	return match.distance, stored.part(match.first, match.last)
+}
+
+// storedVideo is a saved video with all its frames
+type storedVideo struct {
+	msg    Message
+	kind   MediaKind
+	frames *frameSequence
+}
+
+// scanVideos reads rows of videos joined with their frames, ordered by chat, message and frame:
+// id, userId, chatId, sentDate, kind, durationMs, shownAtMs, pHash, dHash
+func scanVideos(rows *sql.Rows) ([]*storedVideo, error) {
+	defer rows.Close()
+
+	// Frames of one video come one after another
+	var videos []*storedVideo
+	var video *storedVideo
+	for rows.Next() {
+		var msg Message
+		var kind MediaKind
+		var duration, shownAt int
+		var pHash, dHash int64
+		err := rows.Scan(
+			&msg.ID,
+			&msg.UserID,
+			&msg.ChatID,
+			&msg.SentDate,
+			&kind,
+			&duration,
+			&shownAt,
+			&pHash,
+			&dHash,
+		)
+		if err != nil {
+			return nil, errors.Wrap(err, "scanning video frame")
+		}
+
+		if video == nil || msg.ID != video.msg.ID || msg.ChatID != video.msg.ChatID {
+			video = &storedVideo{msg: msg, kind: kind, frames: &frameSequence{duration: duration}}
+			videos = append(videos, video)
+		}
+
+		video.frames.pHashes = append(video.frames.pHashes, uint64(pHash))
+		video.frames.dHashes = append(video.frames.dHashes, uint64(dHash))
+		video.frames.times = append(video.frames.times, shownAt)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "reading video frames")
+	}
+
+	return videos, nil
+}
+
+// closestVideos compares candidates with the video and returns ones closer than threshold.
+// The messages are sorted by SortSimilar, if limit is not 0 only the limit closest ones are returned.
+func closestVideos(video *frameSequence, hashType HashType, candidates []*storedVideo, threshold, limit int) []*SimilarVideo {
+	var found []*SimilarVideo
+	for _, candidate := range candidates {
+		dist, part := compareSequences(video, candidate.frames, hashType)
+		if dist < threshold {
+			msg := candidate.msg
+			found = append(found, &SimilarVideo{SimilarMessage: SimilarMessage{Msg: &msg, Distance: dist}, Part: part})
+		}
+	}
+
+	sort.SliceStable(found, func(i, j int) bool {
+		return found[i].Closer(&found[j].SimilarMessage)
+	})
+	if limit != 0 && len(found) > limit {
+		found = found[:limit]
+	}
+
+	return found
+}
+
+func saveVideoFrames(db execer, chatID int64, id int, frames *frameSequence) error {
+	for frame := range frames.pHashes {
+		_, err := db.Exec(`
+			insert or ignore into video_frames (
+				id,
+				chatId,
+				frame,
+				pHash,
+				dHash,
+				shownAtMs
+			) values (
+				:id,
+				:chatId,
+				:frame,
+				:pHash,
+				:dHash,
+				:shownAtMs
+			);`,
+			sql.Named("id", id),
+			sql.Named("chatId", chatID),
+			sql.Named("frame", frame),
+			sql.Named("pHash", int64(frames.pHashes[frame])),
+			sql.Named("dHash", int64(frames.dHashes[frame])),
+			sql.Named("shownAtMs", frames.times[frame]),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
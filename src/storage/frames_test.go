@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+// testFrames are frames of a video that differ from each other by 16 bits
+var testFrames = []uint64{0xFF, 0xFF00, 0xFF0000, 0xFF000000, 0xFF00000000, 0xFF0000000000, 0xFF000000000000, 0xFF00000000000000}
+
+func TestAlignFrames(t *testing.T) {
+	reversed := []uint64{testFrames[5], testFrames[4], testFrames[3], testFrames[2]}
+
+	tests := []struct {
+		name  string
+		short []uint64
+		open  bool
+		want  alignment
+	}{
+		{"whole", testFrames, false, alignment{distance: 0, first: 0, last: 7}},
+		{"whole open", testFrames, true, alignment{distance: 0, first: 0, last: 7}},
+		{"prefix open", testFrames[:3], true, alignment{distance: 0, first: 0, last: 2}},
+		{"prefix closed", testFrames[:3], false, alignment{distance: 10, first: 0, last: 7}},
+		{"suffix open", testFrames[5:], true, alignment{distance: 0, first: 5, last: 7}},
+		{"suffix closed", testFrames[5:], false, alignment{distance: 10, first: 0, last: 7}},
+		{"last frame closed", testFrames[7:], false, alignment{distance: 14, first: 0, last: 7}},
+		{"middle open", testFrames[2:6], true, alignment{distance: 0, first: 2, last: 5}},
+		{"middle closed", testFrames[2:6], false, alignment{distance: 8, first: 0, last: 7}},
+		{"reversed open", reversed, true, alignment{distance: 12, first: 5, last: 7}},
+		{"reversed closed", reversed, false, alignment{distance: 14, first: 0, last: 7}},
+		{"slowed down", []uint64{testFrames[0], testFrames[0], testFrames[1], testFrames[1]}, true, alignment{distance: 0, first: 0, last: 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := alignFrames(tt.short, testFrames, tt.open)
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPartOf(t *testing.T) {
+	tests := []struct {
+		name          string
+		video, longer *frameSequence
+		want          bool
+	}{
+		{"clip", conformanceVideo(testFrames[:4], time.Second).sequence(), conformanceVideo(testFrames, time.Second).sequence(), true},
+		{"few frames", conformanceVideo(testFrames[:3], time.Second).sequence(), conformanceVideo(testFrames, time.Second).sequence(), false},
+		{"short clip", conformanceVideo(testFrames[:4], 10*time.Millisecond).sequence(), conformanceVideo(testFrames, time.Second).sequence(), false},
+		{"unknown duration", &frameSequence{pHashes: testFrames[:4]}, &frameSequence{pHashes: make([]uint64, 40)}, true},
+		{"unknown duration, few frames", &frameSequence{pHashes: testFrames[:4]}, &frameSequence{pHashes: make([]uint64, 41)}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.video.partOf(tt.longer)
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompareSequences(t *testing.T) {
+	long := conformanceVideo(testFrames, time.Second).sequence()
+
+	tests := []struct {
+		name          string
+		video, stored *frameSequence
+		wantDistance  int
+		wantPart      *VideoPart
+	}{
+		{"same", long, long, 0, nil},
+		{"prefix", conformanceVideo(testFrames[:4], time.Second).sequence(), long, 0, &VideoPart{From: 0, To: 4 * time.Second, Duration: 8 * time.Second}},
+		{"middle", conformanceVideo(testFrames[2:6], time.Second).sequence(), long, 0, &VideoPart{From: 2 * time.Second, To: 6 * time.Second, Duration: 8 * time.Second}},
+		{"suffix", conformanceVideo(testFrames[4:], time.Second).sequence(), long, 0, &VideoPart{From: 4 * time.Second, To: 8 * time.Second, Duration: 8 * time.Second}},
+		{"stored clip", long, conformanceVideo(testFrames[4:], time.Second).sequence(), 0, nil},
+		{"short suffix", conformanceVideo(testFrames[5:], time.Second).sequence(), long, 10, nil},
+		{"stored short suffix", long, conformanceVideo(testFrames[5:], time.Second).sequence(), 10, nil},
+		{"reversed", conformanceVideo([]uint64{testFrames[7], testFrames[6], testFrames[5], testFrames[4]}, time.Second).sequence(), long, 12, &VideoPart{From: 5 * time.Second, To: 8 * time.Second, Duration: 8 * time.Second}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dist, part := compareSequences(tt.video, tt.stored, HashPerception)
+			if dist != tt.wantDistance {
+				t.Errorf("distance: got %d, want %d", dist, tt.wantDistance)
+			}
+			if (part == nil) != (tt.wantPart == nil) || part != nil && *part != *tt.wantPart {
+				t.Errorf("part: got %+v, want %+v", part, tt.wantPart)
+			}
+		})
+	}
+}
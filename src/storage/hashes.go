@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/go-faster/errors"
+	"github.com/mattn/go-sqlite3"
+	"math/bits"
+	"strings"
+)
+
+// driverName is sqlite with the hamming() function registered
+const driverName = "sqlite3_bayan"
+
+func init() {
+	sql.Register(driverName, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			return conn.RegisterFunc("hamming", hamming, true)
+		},
+	})
+}
+
+// hamming is the number of differing bits of two hashes stored as integers
+func hamming(a, b int64) int {
+	return bits.OnesCount64(uint64(a ^ b))
+}
+
+func hashColumn(hashType HashType) string {
+	if hashType == HashDifference {
+		return "dHash"
+	}
+	return "pHash"
+}
+
+// sqlLimit turns limit 0 into no limit
+func sqlLimit(limit int) int {
+	if limit == 0 {
+		return -1
+	}
+	return limit
+}
+
+func (s *Storage) findPicturesSQL(chatID int64, kind MediaKind, hashType HashType, hash uint64, threshold, limit int) ([]*SimilarMessage, error) {
+	rows, err := s.db.Query(fmt.Sprintf(`
+		select
+			id,
+			userId,
+			chatId,
+			sentDate,
+			hamming(%[1]s, :hash) as distance
+		from messages
+		where chatId = :chatId
+		and isVideo = 0
+		and kind = :kind
+		and hamming(%[1]s, :hash) < :threshold
+		order by distance, sentDate, id
+		limit :limit;
+	`, hashColumn(hashType)),
+		sql.Named("chatId", chatID),
+		sql.Named("kind", kind),
+		sql.Named("hash", int64(hash)),
+		sql.Named("threshold", threshold),
+		sql.Named("limit", sqlLimit(limit)),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "querying messages")
+	}
+
+	return scanSimilar(rows)
+}
+
+// findVideosSQL loads videos with any frame closer than threshold, then compares them frame by frame
+func (s *Storage) findVideosSQL(chatID int64, kind MediaKind, hashType HashType, video *frameSequence, threshold, limit int) ([]*SimilarVideo, error) {
+	args := []any{
+		sql.Named("chatId", chatID),
+		sql.Named("kind", kind),
+		sql.Named("threshold", threshold),
+	}
+
+	var nearFrame []string
+	for i, hash := range video.hashes(hashType) {
+		nearFrame = append(nearFrame, fmt.Sprintf("hamming(c.%s, :frame%d) < :threshold", hashColumn(hashType), i))
+		args = append(args, sql.Named(fmt.Sprintf("frame%d", i), int64(hash)))
+	}
+
+	rows, err := s.db.Query(fmt.Sprintf(`
+		select
+			m.id,
+			m.userId,
+			m.chatId,
+			m.sentDate,
+			m.kind,
+			m.durationMs,
+			f.shownAtMs,
+			f.pHash,
+			f.dHash
+		from messages m
+		join video_frames f on f.id = m.id and f.chatId = m.chatId
+		where m.chatId = :chatId
+		and m.isVideo = 1
+		and m.kind = :kind
+		and m.id in (
+			select c.id
+			from video_frames c
+			where c.chatId = :chatId
+			and (%s)
+		)
+		order by m.chatId, m.id, f.frame;
+	`, strings.Join(nearFrame, " or ")), args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "querying messages")
+	}
+
+	candidates, err := scanVideos(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	return closestVideos(video, hashType, candidates, threshold, limit), nil
+}
+
+func scanSimilar(rows *sql.Rows) ([]*SimilarMessage, error) {
+	defer rows.Close()
+
+	var messages []*SimilarMessage
+	for rows.Next() {
+		var msg Message
+		var dist int
+		err := rows.Scan(
+			&msg.ID,
+			&msg.UserID,
+			&msg.ChatID,
+			&msg.SentDate,
+			&dist,
+		)
+		if err != nil {
+			return nil, errors.Wrap(err, "scanning message")
+		}
+
+		messages = append(messages, &SimilarMessage{Msg: &msg, Distance: dist})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "reading messages")
+	}
+
+	return messages, nil
+}
@@ -0,0 +1,452 @@
+package storage
+
+import (
+	"database/sql"
+	"github.com/go-faster/errors"
+	"math/bits"
+	"sort"
+	"sync"
+)
+
+// HashType selects which of the perceptual hashes is used to search for similar messages
+type HashType int
+
+const (
+	// HashPerception is the pHash, used to detect reposts
+	HashPerception HashType = iota
+	// HashDifference is the dHash, used by /compare
+	HashDifference
+	// HashCrop is the pHash of center crops of pictures, a picture has several of them
+	HashCrop
+)
+
+// indexKey separates hashes that are never compared with each other
+type indexKey struct {
+	chatID  int64
+	isVideo bool
+	kind    MediaKind
+	hash    HashType
+}
+
+// hashIndex keeps hashes of all messages in memory, so they are not read
+// from the database and decoded on every message.
+// Frames of videos are in the trees one by one, whole videos are compared after a frame is found.
+type hashIndex struct {
+	mu     sync.RWMutex
+	trees  map[indexKey]*bkTree
+	videos map[videoKey]*storedVideo
+}
+
+type videoKey struct {
+	chatID int64
+	id     int
+}
+
+func newHashIndex() *hashIndex {
+	return &hashIndex{
+		trees:  make(map[indexKey]*bkTree),
+		videos: make(map[videoKey]*storedVideo),
+	}
+}
+
+func (idx *hashIndex) insert(key indexKey, hash []uint64, msg Message) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	tree, ok := idx.trees[key]
+	if !ok {
+		tree = &bkTree{}
+		idx.trees[key] = tree
+	}
+
+	tree.insert(hash, msg)
+}
+
+// insertVideo adds every frame of the video to the trees
+func (idx *hashIndex) insertVideo(video *storedVideo) {
+	key := indexKey{chatID: int64(video.msg.ChatID), isVideo: true, kind: video.kind}
+	for _, hashType := range []HashType{HashPerception, HashDifference} {
+		key.hash = hashType
+		for _, hash := range video.frames.hashes(hashType) {
+			idx.insert(key, []uint64{hash}, video.msg)
+		}
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.videos[videoKey{chatID: key.chatID, id: video.msg.ID}] = video
+}
+
+// remove removes messages of the chat matching the filter from all trees of the chat
+func (idx *hashIndex) remove(chatID int64, filter func(msg Message) bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	for key, tree := range idx.trees {
+		if key.chatID == chatID {
+			tree.remove(filter)
+		}
+	}
+
+	for key, video := range idx.videos {
+		if key.chatID == chatID && filter(video.msg) {
+			delete(idx.videos, key)
+		}
+	}
+}
+
+// nearest returns messages with hashes closer than threshold, sorted by distance.
+// If limit is not 0, only the limit closest messages are returned.
+func (idx *hashIndex) nearest(key indexKey, hash []uint64, threshold, limit int) []*SimilarMessage {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	tree, ok := idx.trees[key]
+	if !ok {
+		return nil
+	}
+
+	var found []*SimilarMessage
+	radius := threshold - 1
+	tree.search(hash, radius, func(msg Message, dist int) int {
+		if dist > radius {
+			return radius
+		}
+
+		found = append(found, &SimilarMessage{Msg: &msg, Distance: dist})
+		if limit == 0 || len(found) < limit {
+			return radius
+		}
+
+		// Only messages as close as the worst of the limit closest ones can still get in,
+		// ties are kept until sorting, an earlier one may replace the worst
+		SortSimilar(found)
+		found = found[:limit]
+		radius = found[limit-1].Distance
+		return radius
+	})
+
+	SortSimilar(found)
+	if limit != 0 && len(found) > limit {
+		found = found[:limit]
+	}
+
+	return found
+}
+
+// videosWithFrame returns videos with any frame closer than threshold to any frame of the video.
+// Videos closer than threshold on average have at least one such frame.
+func (idx *hashIndex) videosWithFrame(key indexKey, video *frameSequence, threshold int) []*storedVideo {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	tree, ok := idx.trees[key]
+	if !ok {
+		return nil
+	}
+
+	var candidates []*storedVideo
+	seen := make(map[int]bool)
+	for _, hash := range video.hashes(key.hash) {
+		tree.search([]uint64{hash}, threshold-1, func(msg Message, dist int) int {
+			if seen[msg.ID] {
+				return threshold - 1
+			}
+			seen[msg.ID] = true
+
+			if candidate, ok := idx.videos[videoKey{chatID: key.chatID, id: msg.ID}]; ok {
+				candidates = append(candidates, candidate)
+			}
+			return threshold - 1
+		})
+	}
+
+	return candidates
+}
+
+// SortSimilar sorts messages by distance, the earliest posted first on ties,
+// so the closest match and the original of equally close ones come first
+func SortSimilar(messages []*SimilarMessage) {
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].Closer(messages[j])
+	})
+}
+
+// Closer reports whether the message goes before the other one in SortSimilar order
+func (m *SimilarMessage) Closer(other *SimilarMessage) bool {
+	if m.Distance != other.Distance {
+		return m.Distance < other.Distance
+	}
+	return m.Msg.Before(other.Msg)
+}
+
+// bkTree is a BK-tree in Hamming space. Keys can be several hashes, the distance
+// between keys is the sum of distances of the hashes. The triangle inequality
+// lets the search skip most of the tree.
+type bkTree struct {
+	root *bkNode
+}
+
+type bkNode struct {
+	hash []uint64
+	// messages have the same hash, exact copies are common
+	messages []Message
+	children map[int]*bkNode
+}
+
+func hashDistance(a, b []uint64) int {
+	dist := 0
+	for i := range a {
+		dist += bits.OnesCount64(a[i] ^ b[i])
+	}
+	return dist
+}
+
+func (t *bkTree) insert(hash []uint64, msg Message) {
+	if t.root == nil {
+		t.root = &bkNode{hash: hash, messages: []Message{msg}}
+		return
+	}
+
+	node := t.root
+	for {
+		dist := hashDistance(node.hash, hash)
+		if dist == 0 {
+			node.messages = append(node.messages, msg)
+			return
+		}
+
+		child, ok := node.children[dist]
+		if !ok {
+			if node.children == nil {
+				node.children = make(map[int]*bkNode)
+			}
+			node.children[dist] = &bkNode{hash: hash, messages: []Message{msg}}
+			return
+		}
+
+		node = child
+	}
+}
+
+// remove removes matching messages, but keeps the nodes, they are still needed to find their children
+func (t *bkTree) remove(filter func(msg Message) bool) {
+	if t.root == nil {
+		return
+	}
+
+	stack := []*bkNode{t.root}
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		kept := node.messages[:0]
+		for _, msg := range node.messages {
+			if !filter(msg) {
+				kept = append(kept, msg)
+			}
+		}
+		node.messages = kept
+
+		for _, child := range node.children {
+			stack = append(stack, child)
+		}
+	}
+}
+
+// search calls visit for every message within radius of the hash. visit returns
+// the radius to continue with, so k-nearest searches can narrow it down as they go.
+func (t *bkTree) search(hash []uint64, radius int, visit func(msg Message, dist int) int) {
+	if t.root == nil {
+		return
+	}
+
+	stack := []*bkNode{t.root}
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		dist := hashDistance(node.hash, hash)
+		if dist <= radius {
+			for _, msg := range node.messages {
+				radius = visit(msg, dist)
+			}
+		}
+
+		for childDist, child := range node.children {
+			if childDist >= dist-radius && childDist <= dist+radius {
+				stack = append(stack, child)
+			}
+		}
+	}
+}
+
+// loadIndex reads hashes of messages matching the filter into the index.
+// The filter is a condition on the messages table aliased as m, empty for all messages.
+func (s *Storage) loadIndex(filter string, args []any) error {
+	rows, err := s.db.Query(`
+		select
+			m.id,
+			m.userId,
+			m.chatId,
+			m.sentDate,
+			m.kind,
+			m.pHash,
+			m.dHash
+		from messages m
+		where m.isVideo = 0
+		`+filter+`;
+	`, args...)
+	if err != nil {
+		return errors.Wrap(err, "querying pictures")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var msg Message
+		var kind MediaKind
+		var pHash, dHash int64
+		err = rows.Scan(
+			&msg.ID,
+			&msg.UserID,
+			&msg.ChatID,
+			&msg.SentDate,
+			&kind,
+			&pHash,
+			&dHash,
+		)
+		if err != nil {
+			return errors.Wrap(err, "scanning picture")
+		}
+
+		s.indexPicture(msg, kind, uint64(pHash), uint64(dHash))
+	}
+	if err = rows.Err(); err != nil {
+		return errors.Wrap(err, "reading pictures")
+	}
+
+	rows, err = s.db.Query(`
+		select
+			m.id,
+			m.userId,
+			m.chatId,
+			m.sentDate,
+			m.kind,
+			m.durationMs,
+			f.shownAtMs,
+			f.pHash,
+			f.dHash
+		from messages m
+		join video_frames f on f.id = m.id and f.chatId = m.chatId
+		where m.isVideo = 1
+		`+filter+`
+		order by m.chatId, m.id, f.frame;
+	`, args...)
+	if err != nil {
+		return errors.Wrap(err, "querying videos")
+	}
+
+	videos, err := scanVideos(rows)
+	if err != nil {
+		return err
+	}
+
+	for _, video := range videos {
+		s.index.insertVideo(video)
+	}
+
+	rows, err = s.db.Query(`
+		select
+			m.id,
+			m.userId,
+			m.chatId,
+			m.sentDate,
+			m.kind,
+			c.pHash
+		from messages m
+		join picture_crops c on c.id = m.id and c.chatId = m.chatId
+		where m.isVideo = 0
+		`+filter+`;
+	`, args...)
+	if err != nil {
+		return errors.Wrap(err, "querying crops")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var msg Message
+		var kind MediaKind
+		var pHash int64
+		err = rows.Scan(
+			&msg.ID,
+			&msg.UserID,
+			&msg.ChatID,
+			&msg.SentDate,
+			&kind,
+			&pHash,
+		)
+		if err != nil {
+			return errors.Wrap(err, "scanning crop")
+		}
+
+		key := indexKey{chatID: int64(msg.ChatID), kind: kind, hash: HashCrop}
+		s.index.insert(key, []uint64{uint64(pHash)}, msg)
+	}
+	if err = rows.Err(); err != nil {
+		return errors.Wrap(err, "reading crops")
+	}
+
+	return nil
+}
+
+// indexMessage adds a just saved message to the index
+func (s *Storage) indexMessage(chatID int64, id int) error {
+	return s.loadIndex("and m.id = :id and m.chatId = :chatId", []any{
+		sql.Named("id", id),
+		sql.Named("chatId", chatID),
+	})
+}
+
+func (s *Storage) indexPicture(msg Message, kind MediaKind, pHash, dHash uint64) {
+	key := indexKey{chatID: int64(msg.ChatID), kind: kind}
+	key.hash = HashPerception
+	s.index.insert(key, []uint64{pHash}, msg)
+	key.hash = HashDifference
+	s.index.insert(key, []uint64{dHash}, msg)
+}
+
+// FindPicturesNear finds pictures of the given kind with hashes closer than threshold
+// to the given one. The messages are sorted by distance, closest first.
+// If limit is 0, all of them are returned, otherwise only the limit closest ones.
+// With HashCrop, the distance is of the closest crop of the picture.
+func (s *Storage) FindPicturesNear(chatID int64, kind MediaKind, hashType HashType, hash uint64, threshold, limit int) ([]*SimilarMessage, error) {
+	if s.index == nil {
+		if hashType == HashCrop {
+			return s.findCropsSQL(chatID, kind, hash, threshold, limit)
+		}
+		return s.findPicturesSQL(chatID, kind, hashType, hash, threshold, limit)
+	}
+
+	key := indexKey{chatID: chatID, kind: kind, hash: hashType}
+	if hashType == HashCrop {
+		return closestPerMessage(s.index.nearest(key, []uint64{hash}, threshold, 0), limit), nil
+	}
+	return s.index.nearest(key, []uint64{hash}, threshold, limit), nil
+}
+
+// FindVideosNear works like FindPicturesNear for videos.
+// Frames are aligned in order, so clips cut from a stored video are found too, see alignFrames.
+// The distance is the average distance of the aligned frames.
+func (s *Storage) FindVideosNear(chatID int64, kind MediaKind, hashType HashType, hashes *VideoHashes, threshold, limit int) ([]*SimilarVideo, error) {
+	video := hashes.sequence()
+	if len(video.pHashes) == 0 {
+		return nil, nil
+	}
+
+	if s.index == nil {
+		return s.findVideosSQL(chatID, kind, hashType, video, threshold, limit)
+	}
+
+	key := indexKey{chatID: chatID, isVideo: true, kind: kind, hash: hashType}
+	return closestVideos(video, hashType, s.index.videosWithFrame(key, video, threshold), threshold, limit), nil
+}
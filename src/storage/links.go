@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"database/sql"
+	"github.com/go-faster/errors"
+	"github.com/go-telegram/bot/models"
+)
+
+// SaveLinks saves canonical links shared in the message
+func (s *Storage) SaveLinks(msg *models.Message, links []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "beginning transaction")
+	}
+	defer tx.Rollback()
+
+	for _, link := range links {
+		_, err = tx.Exec(`
+			insert or ignore into links (
+				id,
+				userId,
+				chatId,
+				sentDate,
+				link
+			) values (
+				:id,
+				:userId,
+				:chatId,
+				:sentDate,
+				:link
+			);`,
+			sql.Named("id", msg.ID),
+			sql.Named("userId", senderID(msg)),
+			sql.Named("chatId", msg.Chat.ID),
+			sql.Named("sentDate", msg.Date),
+			sql.Named("link", link),
+		)
+		if err != nil {
+			return errors.Wrap(err, "saving link to database")
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "committing transaction")
+	}
+
+	return nil
+}
+
+// FindLink finds the first message in the chat that shared the same canonical link.
+// Returns nil if there is no such message.
+func (s *Storage) FindLink(chatID int64, link string) (*SimilarMessage, error) {
+	var msg Message
+	err := s.db.QueryRow(`
+		select
+			id,
+			userId,
+			chatId,
+			sentDate
+		from links
+		where chatId = :chatId
+		and link = :link
+		order by sentDate, id
+		limit 1;
+	`,
+		sql.Named("chatId", chatID),
+		sql.Named("link", link),
+	).Scan(
+		&msg.ID,
+		&msg.UserID,
+		&msg.ChatID,
+		&msg.SentDate,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "querying link")
+	}
+
+	return &SimilarMessage{Msg: &msg, Distance: 0}, nil
+}
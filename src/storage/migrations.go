@@ -0,0 +1,769 @@
+package storage
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/gob"
+	"fmt"
+	"github.com/corona10/goimagehash"
+	"github.com/go-faster/errors"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Migration is one change of the database schema, versions start from 1
+type Migration struct {
+	Version     int
+	Description string
+	up          func(tx *sql.Tx) error
+}
+
+// sqliteMigrations are applied in order, each in its own transaction.
+// Never change a released migration, add a new one instead.
+// Databases created before versioning have no schema_version table, so the first
+// migrations check what's already there and bring any of them to the same schema.
+var sqliteMigrations = []Migration{
+	{
+		Version:     1,
+		Description: "create messages table",
+		up: func(tx *sql.Tx) error {
+			_, err := tx.Exec(`
+				create table if not exists messages (
+					id integer not null,
+					userId integer not null,
+					chatId integer not null,
+					sentDate timestamp not null,
+					isVideo integer not null,
+					pHash blob not null,
+					dHash blob not null,
+					primary key (id, chatId)
+				);
+			`)
+			return err
+		},
+	},
+	{
+		Version:     2,
+		Description: "add media kind, file ids and checksums to messages",
+		up: func(tx *sql.Tx) error {
+			err := addColumn(tx, "messages", "kind", "integer not null default 0")
+			if err != nil {
+				return errors.Wrap(err, "adding kind column")
+			}
+
+			err = addColumn(tx, "messages", "fileUniqueId", "text not null default ''")
+			if err != nil {
+				return errors.Wrap(err, "adding fileUniqueId column")
+			}
+
+			err = addColumn(tx, "messages", "stickerSet", "text not null default ''")
+			if err != nil {
+				return errors.Wrap(err, "adding stickerSet column")
+			}
+
+			err = addColumn(tx, "messages", "sha256", "text not null default ''")
+			if err != nil {
+				return errors.Wrap(err, "adding sha256 column")
+			}
+
+			_, err = tx.Exec(`
+				create index if not exists messages_file_unique_id on messages (chatId, fileUniqueId);
+				create index if not exists messages_sha256 on messages (chatId, sha256);
+			`)
+			return err
+		},
+	},
+	{
+		Version:     3,
+		Description: "create chat_settings table",
+		up: func(tx *sql.Tx) error {
+			_, err := tx.Exec(`
+				create table if not exists chat_settings (
+					chatId integer not null primary key,
+					stickers integer not null
+				);
+			`)
+			return err
+		},
+	},
+	{
+		Version:     4,
+		Description: "create forwards table",
+		up: func(tx *sql.Tx) error {
+			_, err := tx.Exec(`
+				create table if not exists forwards (
+					id integer not null,
+					userId integer not null,
+					chatId integer not null,
+					sentDate timestamp not null,
+					originKey text not null,
+					originDate timestamp not null,
+					primary key (id, chatId)
+				);
+				create index if not exists forwards_origin_key on forwards (chatId, originKey);
+			`)
+			return err
+		},
+	},
+	{
+		Version:     5,
+		Description: "create links table",
+		up: func(tx *sql.Tx) error {
+			_, err := tx.Exec(`
+				create table if not exists links (
+					id integer not null,
+					userId integer not null,
+					chatId integer not null,
+					sentDate timestamp not null,
+					link text not null,
+					primary key (id, chatId, link)
+				);
+				create index if not exists links_link on links (chatId, link);
+			`)
+			return err
+		},
+	},
+	{
+		Version:     6,
+		Description: "create audio table",
+		up: func(tx *sql.Tx) error {
+			_, err := tx.Exec(`
+				create table if not exists audio (
+					id integer not null,
+					userId integer not null,
+					chatId integer not null,
+					sentDate timestamp not null,
+					kind integer not null,
+					fileUniqueId text not null,
+					duration integer not null,
+					fingerprint blob not null,
+					primary key (id, chatId)
+				);
+			`)
+			return err
+		},
+	},
+	{
+		Version:     7,
+		Description: "store hashes as integers",
+		up:          migrateHashBlobs,
+	},
+	{
+		Version:     8,
+		Description: "create clusters table",
+		up: func(tx *sql.Tx) error {
+			_, err := tx.Exec(`
+				create table if not exists clusters (
+					id integer not null,
+					userId integer not null,
+					userName text not null,
+					chatId integer not null,
+					sentDate timestamp not null,
+					rootId integer not null,
+					primary key (id, chatId)
+				);
+				create index if not exists clusters_root on clusters (chatId, rootId);
+			`)
+			return err
+		},
+	},
+	{
+		Version:     9,
+		Description: "create detections table",
+		up: func(tx *sql.Tx) error {
+			_, err := tx.Exec(`
+				create table if not exists detections (
+					id integer not null,
+					chatId integer not null,
+					matchId integer not null,
+					kind integer not null,
+					algorithm text not null,
+					distance integer not null,
+					threshold integer not null,
+					nearMiss integer not null,
+					detectedAt timestamp not null,
+					primary key (id, chatId, matchId, algorithm)
+				);
+				create index if not exists detections_match on detections (chatId, matchId);
+				create index if not exists detections_date on detections (chatId, detectedAt);
+			`)
+			return err
+		},
+	},
+	{
+		Version:     10,
+		Description: "create chat_thresholds table",
+		up: func(tx *sql.Tx) error {
+			_, err := tx.Exec(`
+				create table if not exists chat_thresholds (
+					chatId integer not null,
+					media text not null,
+					threshold integer not null,
+					primary key (chatId, media)
+				);
+			`)
+			return err
+		},
+	},
+	{
+		Version:     11,
+		Description: "create reviews table",
+		up: func(tx *sql.Tx) error {
+			_, err := tx.Exec(`
+				create table if not exists reviews (
+					id integer not null,
+					chatId integer not null,
+					userId integer not null,
+					userName text not null,
+					sentDate timestamp not null,
+					matchId integer not null,
+					matchUserId integer not null,
+					matchSentDate timestamp not null,
+					kind integer not null,
+					algorithm text not null,
+					distance integer not null,
+					threshold integer not null,
+					score integer not null,
+					createdAt timestamp not null,
+					primary key (id, chatId, matchId)
+				);
+				create index if not exists reviews_match on reviews (chatId, matchId);
+			`)
+			return err
+		},
+	},
+	{
+		Version:     12,
+		Description: "create picture_crops table",
+		up: func(tx *sql.Tx) error {
+			_, err := tx.Exec(`
+				create table if not exists picture_crops (
+					id integer not null,
+					chatId integer not null,
+					crop integer not null,
+					pHash integer not null,
+					primary key (id, chatId, crop)
+				);
+			`)
+			return err
+		},
+	},
+	{
+		Version:     13,
+		Description: "add frame times and video durations",
+		up: func(tx *sql.Tx) error {
+			// Both are in milliseconds, videos saved before have zeros
+			err := addColumn(tx, "video_frames", "shownAtMs", "integer not null default 0")
+			if err != nil {
+				return errors.Wrap(err, "adding shownAtMs column")
+			}
+
+			err = addColumn(tx, "messages", "durationMs", "integer not null default 0")
+			if err != nil {
+				return errors.Wrap(err, "adding durationMs column")
+			}
+
+			return nil
+		},
+	},
+	{
+		Version:     14,
+		Description: "drop stickerSet column",
+		up: func(tx *sql.Tx) error {
+			// Stickers are matched by file and hashes, the set name was never used
+			_, err := tx.Exec(`alter table messages drop column stickerSet;`)
+			return err
+		},
+	},
+	{
+		Version:     15,
+		Description: "move texts to texts table",
+		up: func(tx *sql.Tx) error {
+			// Captions are texts of messages that have media too, so texts can't share
+			// the primary key of messages. Kind 3 is KindText.
+			_, err := tx.Exec(`
+				create table if not exists texts (
+					id integer not null,
+					userId integer not null,
+					chatId integer not null,
+					sentDate timestamp not null,
+					simHash integer not null,
+					primary key (id, chatId)
+				);
+				insert or ignore into texts (
+					id,
+					userId,
+					chatId,
+					sentDate,
+					simHash
+				) select
+					id,
+					userId,
+					chatId,
+					sentDate,
+					pHash
+				from messages
+				where kind = 3;
+				delete from messages where kind = 3;
+			`)
+			return err
+		},
+	},
+	{
+		Version:     16,
+		Description: "add sha256 and file indexes to audio",
+		up: func(tx *sql.Tx) error {
+			err := addColumn(tx, "audio", "sha256", "text not null default ''")
+			if err != nil {
+				return errors.Wrap(err, "adding sha256 column")
+			}
+
+			_, err = tx.Exec(`
+				create index if not exists audio_file_unique_id on audio (chatId, fileUniqueId);
+				create index if not exists audio_sha256 on audio (chatId, sha256);
+			`)
+			return err
+		},
+	},
+}
+
+// migrate applies migrations the database doesn't have yet.
+// Queries here are the same for SQLite and PostgreSQL.
+// lock is run at the start of every migration transaction, empty if the database needs none.
+func migrate(db *sql.DB, lock string, migrations []Migration) error {
+	tx, err := beginMigration(db, lock)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		create table if not exists schema_version (
+			version integer not null primary key,
+			description text not null,
+			appliedAt timestamp not null
+		);
+	`)
+	if err != nil {
+		return errors.Wrap(err, "creating schema_version table")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "creating schema_version table")
+	}
+
+	for _, m := range migrations {
+		err = applyMigration(db, lock, m)
+		if err != nil {
+			return errors.Wrapf(err, "applying migration %d (%s)", m.Version, m.Description)
+		}
+	}
+
+	return nil
+}
+
+// beginMigration starts a transaction and runs the lock statement in it, if there is one,
+// so instances started at the same time apply migrations one by one
+func beginMigration(db *sql.DB, lock string) (*sql.Tx, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, errors.Wrap(err, "beginning transaction")
+	}
+
+	if lock != "" {
+		_, err = tx.Exec(lock)
+		if err != nil {
+			tx.Rollback()
+			return nil, errors.Wrap(err, "locking schema_version")
+		}
+	}
+
+	return tx, nil
+}
+
+// applyMigration applies the migration unless it was applied already, the version
+// is read after the lock is taken, another instance could have migrated the database meanwhile
+func applyMigration(db *sql.DB, lock string, m Migration) error {
+	tx, err := beginMigration(db, lock)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	version, err := schemaVersion(tx)
+	if err != nil {
+		return err
+	}
+	if m.Version <= version {
+		return nil
+	}
+
+	err = m.up(tx)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		insert into schema_version (
+			version,
+			description,
+			appliedAt
+		) values ($1, $2, $3);`,
+		m.Version,
+		m.Description,
+		time.Now().UTC(),
+	)
+	if err != nil {
+		return errors.Wrap(err, "saving schema version")
+	}
+
+	return tx.Commit()
+}
+
+// rowQuerier is a database or a transaction
+type rowQuerier interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// schemaVersion is 0 for new databases and databases created before versioning
+func schemaVersion(db rowQuerier) (int, error) {
+	var version int
+	err := db.QueryRow(`select coalesce(max(version), 0) from schema_version;`).Scan(&version)
+	if err != nil {
+		return 0, errors.Wrap(err, "querying schema version")
+	}
+
+	return version, nil
+}
+
+// SchemaStatus returns the schema version of the database and migrations
+// that will be applied on the next start. The database is not changed.
+func SchemaStatus(filepath string) (version int, pending []Migration, err error) {
+	_, err = os.Stat(filepath)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, nil, errors.Wrap(err, "checking database file")
+	}
+
+	if err == nil {
+		version, err = readSchemaVersion(filepath)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	return version, pendingMigrations(sqliteMigrations, version), nil
+}
+
+func pendingMigrations(migrations []Migration, version int) []Migration {
+	var pending []Migration
+	for _, m := range migrations {
+		if m.Version > version {
+			pending = append(pending, m)
+		}
+	}
+	return pending
+}
+
+func readSchemaVersion(filepath string) (int, error) {
+	db, err := sql.Open(driverName, "file:"+filepath+"?mode=ro")
+	if err != nil {
+		return 0, errors.Wrap(err, "opening sqlite database")
+	}
+	defer db.Close()
+
+	var tables int
+	err = db.QueryRow(`select count(*) from sqlite_master where type = 'table' and name = 'schema_version';`).Scan(&tables)
+	if err != nil {
+		return 0, errors.Wrap(err, "querying tables")
+	}
+
+	if tables == 0 {
+		return 0, nil
+	}
+
+	return schemaVersion(db)
+}
+
+// addColumn adds a column to a table created by an older version, if it's not there yet
+func addColumn(tx *sql.Tx, table, column, definition string) error {
+	var exists int
+	err := tx.QueryRow(
+		`select count(*) from pragma_table_info(:table) where name = :column;`,
+		sql.Named("table", table),
+		sql.Named("column", column),
+	).Scan(&exists)
+	if err != nil {
+		return errors.Wrap(err, "querying table info")
+	}
+
+	if exists > 0 {
+		return nil
+	}
+
+	_, err = tx.Exec(fmt.Sprintf("alter table %s add column %s %s;", table, column, definition))
+	if err != nil {
+		return errors.Wrap(err, "altering table")
+	}
+
+	return nil
+}
+
+// migrateHashBlobs converts gob encoded hashes to integer columns.
+// Hashes of pictures and texts go to pHash and dHash, hashes of video frames go to video_frames.
+// Hashes are unsigned, but sqlite integers are signed, so they are stored with the same bits.
+func migrateHashBlobs(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		create table if not exists video_frames (
+			id integer not null,
+			chatId integer not null,
+			frame integer not null,
+			pHash integer not null,
+			dHash integer not null,
+			primary key (id, chatId, frame)
+		);
+	`)
+	if err != nil {
+		return errors.Wrap(err, "creating video_frames table")
+	}
+
+	var columnType string
+	err = tx.QueryRow(`select type from pragma_table_info('messages') where name = 'pHash';`).Scan(&columnType)
+	if err != nil {
+		return errors.Wrap(err, "querying pHash column type")
+	}
+
+	if !strings.EqualFold(columnType, "blob") {
+		return nil
+	}
+
+	_, err = tx.Exec(`
+		create table messages_new (
+			id integer not null,
+			userId integer not null,
+			chatId integer not null,
+			sentDate timestamp not null,
+			isVideo integer not null,
+			kind integer not null default 0,
+			fileUniqueId text not null default '',
+			stickerSet text not null default '',
+			sha256 text not null default '',
+			pHash integer,
+			dHash integer,
+			pHashKind integer not null default 0,
+			dHashKind integer not null default 0,
+			primary key (id, chatId)
+		);
+		insert into messages_new (
+			id,
+			userId,
+			chatId,
+			sentDate,
+			isVideo,
+			kind,
+			fileUniqueId,
+			stickerSet,
+			sha256
+		) select
+			id,
+			userId,
+			chatId,
+			sentDate,
+			isVideo,
+			kind,
+			fileUniqueId,
+			stickerSet,
+			sha256
+		from messages;
+	`)
+	if err != nil {
+		return errors.Wrap(err, "copying messages")
+	}
+
+	type blobRow struct {
+		id                     int
+		chatID                 int64
+		isVideo                bool
+		pHashBytes, dHashBytes []byte
+	}
+
+	rows, err := tx.Query(`select id, chatId, isVideo, pHash, dHash from messages;`)
+	if err != nil {
+		return errors.Wrap(err, "querying messages")
+	}
+
+	var blobs []blobRow
+	for rows.Next() {
+		var row blobRow
+		err = rows.Scan(&row.id, &row.chatID, &row.isVideo, &row.pHashBytes, &row.dHashBytes)
+		if err != nil {
+			rows.Close()
+			return errors.Wrap(err, "scanning message")
+		}
+		blobs = append(blobs, row)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return errors.Wrap(err, "reading messages")
+	}
+
+	for _, row := range blobs {
+		if row.isVideo {
+			pHashes, err := loadLegacyVideoHashes(bytes.NewReader(row.pHashBytes))
+			if err != nil {
+				return errors.Wrap(err, "loading pHash")
+			}
+			dHashes, err := loadLegacyVideoHashes(bytes.NewReader(row.dHashBytes))
+			if err != nil {
+				return errors.Wrap(err, "loading dHash")
+			}
+
+			err = setHashKinds(tx, row.chatID, row.id, pHashes.FrameA.GetKind(), dHashes.FrameA.GetKind())
+			if err != nil {
+				return err
+			}
+
+			err = saveFrames(tx, row.chatID, row.id, pHashes.frames(), dHashes.frames())
+			if err != nil {
+				return errors.Wrap(err, "saving frames")
+			}
+			continue
+		}
+
+		pHash, err := goimagehash.LoadImageHash(bytes.NewReader(row.pHashBytes))
+		if err != nil {
+			return errors.Wrap(err, "loading pHash")
+		}
+		dHash, err := goimagehash.LoadImageHash(bytes.NewReader(row.dHashBytes))
+		if err != nil {
+			return errors.Wrap(err, "loading dHash")
+		}
+
+		_, err = tx.Exec(`
+			update messages_new
+			set pHash = :pHash, dHash = :dHash
+			where id = :id
+			and chatId = :chatId;`,
+			sql.Named("pHash", int64(pHash.GetHash())),
+			sql.Named("dHash", int64(dHash.GetHash())),
+			sql.Named("id", row.id),
+			sql.Named("chatId", row.chatID),
+		)
+		if err != nil {
+			return errors.Wrap(err, "updating hashes")
+		}
+
+		err = setHashKinds(tx, row.chatID, row.id, pHash.GetKind(), dHash.GetKind())
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`
+		drop table messages;
+		alter table messages_new rename to messages;
+		create index if not exists messages_file_unique_id on messages (chatId, fileUniqueId);
+		create index if not exists messages_sha256 on messages (chatId, sha256);
+	`)
+	if err != nil {
+		return errors.Wrap(err, "replacing messages table")
+	}
+
+	return nil
+}
+
+// legacyVideoHashes are the four frames videos were hashed to before frames were taken at scene changes
+type legacyVideoHashes struct {
+	FrameA *goimagehash.ImageHash
+	FrameB *goimagehash.ImageHash
+	FrameC *goimagehash.ImageHash
+	FrameD *goimagehash.ImageHash
+}
+
+// loadLegacyVideoHashes decodes the gob encoded hashes of four frames
+func loadLegacyVideoHashes(b io.Reader) (*legacyVideoHashes, error) {
+	type H struct {
+		Hash uint64
+		Kind goimagehash.Kind
+	}
+	type D struct {
+		FrameA H
+		FrameB H
+		FrameC H
+		FrameD H
+	}
+
+	var d D
+	dec := gob.NewDecoder(b)
+	err := dec.Decode(&d)
+	if err != nil {
+		return nil, err
+	}
+
+	return &legacyVideoHashes{
+		FrameA: goimagehash.NewImageHash(d.FrameA.Hash, d.FrameA.Kind),
+		FrameB: goimagehash.NewImageHash(d.FrameB.Hash, d.FrameB.Kind),
+		FrameC: goimagehash.NewImageHash(d.FrameC.Hash, d.FrameC.Kind),
+		FrameD: goimagehash.NewImageHash(d.FrameD.Hash, d.FrameD.Kind),
+	}, nil
+}
+
+func (h *legacyVideoHashes) frames() []uint64 {
+	return []uint64{
+		h.FrameA.GetHash(),
+		h.FrameB.GetHash(),
+		h.FrameC.GetHash(),
+		h.FrameD.GetHash(),
+	}
+}
+
+// saveFrames saves the four frames of a legacy video, the frames have no times
+func saveFrames(db execer, chatID int64, id int, pHashes, dHashes []uint64) error {
+	for frame := range pHashes {
+		_, err := db.Exec(`
+			insert or ignore into video_frames (
+				id,
+				chatId,
+				frame,
+				pHash,
+				dHash
+			) values (
+				:id,
+				:chatId,
+				:frame,
+				:pHash,
+				:dHash
+			);`,
+			sql.Named("id", id),
+			sql.Named("chatId", chatID),
+			sql.Named("frame", frame),
+			sql.Named("pHash", int64(pHashes[frame])),
+			sql.Named("dHash", int64(dHashes[frame])),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func setHashKinds(tx *sql.Tx, chatID int64, id int, pHashKind, dHashKind goimagehash.Kind) error {
+	_, err := tx.Exec(`
+		update messages_new
+		set pHashKind = :pHashKind, dHashKind = :dHashKind
+		where id = :id
+		and chatId = :chatId;`,
+		sql.Named("pHashKind", pHashKind),
+		sql.Named("dHashKind", dHashKind),
+		sql.Named("id", id),
+		sql.Named("chatId", chatID),
+	)
+	if err != nil {
+		return errors.Wrap(err, "updating hash kinds")
+	}
+
+	return nil
+}
@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"database/sql"
+	"github.com/go-faster/errors"
+	"github.com/go-telegram/bot/models"
+	"time"
+)
+
+// Review is a possible repost waiting for chat admins to confirm or dismiss it
+type Review struct {
+	// Msg is the new message posted by UserName, Match is the older message it may be a copy of
+	Msg      *Message
+	UserName string
+	Match    *Message
+	// Kind, Algorithm, Distance and Threshold describe the comparison Match was found by
+	Kind      MediaKind
+	Algorithm Algorithm
+	Distance  int
+	Threshold int
+	// Score is from 0 to 100, how sure the bot is that Msg is a copy of Match
+	Score     int
+	CreatedAt time.Time
+}
+
+// SaveReview queues a comparison of the message with the matched one for review
+func (s *Storage) SaveReview(msg *models.Message, match *Message, kind MediaKind, algorithm Algorithm, distance, threshold, score int) error {
+	node, userName := clusterNode(msg)
+	_, err := s.db.Exec(`
+		insert or ignore into reviews (
+			id,
+			chatId,
+			userId,
+			userName,
+			sentDate,
+			matchId,
+			matchUserId,
+			matchSentDate,
+			kind,
+			algorithm,
+			distance,
+			threshold,
+			score,
+			createdAt
+		) values (
+			:id,
+			:chatId,
+			:userId,
+			:userName,
+			:sentDate,
+			:matchId,
+			:matchUserId,
+			:matchSentDate,
+			:kind,
+			:algorithm,
+			:distance,
+			:threshold,
+			:score,
+			:createdAt
+		);`,
+		sql.Named("id", node.ID),
+		sql.Named("chatId", node.ChatID),
+		sql.Named("userId", node.UserID),
+		sql.Named("userName", userName),
+		sql.Named("sentDate", node.SentDate.Unix()),
+		sql.Named("matchId", match.ID),
+		sql.Named("matchUserId", match.UserID),
+		sql.Named("matchSentDate", match.SentDate.Unix()),
+		sql.Named("kind", kind),
+		sql.Named("algorithm", algorithm),
+		sql.Named("distance", distance),
+		sql.Named("threshold", threshold),
+		sql.Named("score", score),
+		sql.Named("createdAt", time.Now().UTC().Unix()),
+	)
+	if err != nil {
+		return errors.Wrap(err, "saving review to database")
+	}
+
+	return nil
+}
+
+func scanReviews(rows *sql.Rows) ([]*Review, error) {
+	defer rows.Close()
+
+	var reviews []*Review
+	for rows.Next() {
+		r := Review{
+			Msg:   &Message{},
+			Match: &Message{},
+		}
+		err := rows.Scan(
+			&r.Msg.ID,
+			&r.Msg.ChatID,
+			&r.Msg.UserID,
+			&r.UserName,
+			&r.Msg.SentDate,
+			&r.Match.ID,
+			&r.Match.UserID,
+			&r.Match.SentDate,
+			&r.Kind,
+			&r.Algorithm,
+			&r.Distance,
+			&r.Threshold,
+			&r.Score,
+			&r.CreatedAt,
+		)
+		if err != nil {
+			return nil, errors.Wrap(err, "scanning review")
+		}
+
+		r.Match.ChatID = r.Msg.ChatID
+		reviews = append(reviews, &r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "reading reviews")
+	}
+
+	return reviews, nil
+}
+
+// GetReviews returns reviews queued in the chat, oldest first.
+// If limit is 0, all of them are returned.
+func (s *Storage) GetReviews(chatID int64, limit int) ([]*Review, error) {
+	rows, err := s.db.Query(`
+		select
+			id,
+			chatId,
+			userId,
+			userName,
+			sentDate,
+			matchId,
+			matchUserId,
+			matchSentDate,
+			kind,
+			algorithm,
+			distance,
+			threshold,
+			score,
+			createdAt
+		from reviews
+		where chatId = :chatId
+		order by createdAt, id, score desc, matchId
+		limit :limit;`,
+		sql.Named("chatId", chatID),
+		sql.Named("limit", sqlLimit(limit)),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "querying reviews")
+	}
+
+	return scanReviews(rows)
+}
+
+// GetMessageReviews returns reviews of the new message, the most likely match first
+func (s *Storage) GetMessageReviews(chatID int64, id int) ([]*Review, error) {
+	rows, err := s.db.Query(`
+		select
+			id,
+			chatId,
+			userId,
+			userName,
+			sentDate,
+			matchId,
+			matchUserId,
+			matchSentDate,
+			kind,
+			algorithm,
+			distance,
+			threshold,
+			score,
+			createdAt
+		from reviews
+		where chatId = :chatId
+		and id = :id
+		order by score desc, matchSentDate, matchId;`,
+		sql.Named("chatId", chatID),
+		sql.Named("id", id),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "querying reviews")
+	}
+
+	return scanReviews(rows)
+}
+
+// DeleteReviews removes reviews of the new message from the queue
+func (s *Storage) DeleteReviews(chatID int64, id int) error {
+	_, err := s.db.Exec(`
+		delete from reviews
+		where chatId = :chatId
+		and id = :id;`,
+		sql.Named("chatId", chatID),
+		sql.Named("id", id),
+	)
+	if err != nil {
+		return errors.Wrap(err, "deleting reviews")
+	}
+
+	return nil
+}
@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"database/sql"
+	"github.com/go-faster/errors"
+)
+
+// ChatSettings are per-chat options changed by chat admins
+type ChatSettings struct {
+	ChatID   int64
+	Stickers bool
+}
+
+// GetChatSettings returns nil if the chat has never changed its settings.
+func (s *Storage) GetChatSettings(chatID int64) (*ChatSettings, error) {
+	settings := ChatSettings{ChatID: chatID}
+	err := s.db.QueryRow(`
+		select stickers
+		from chat_settings
+		where chatId = :chatId;
+	`, sql.Named("chatId", chatID)).Scan(&settings.Stickers)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "querying chat settings")
+	}
+
+	return &settings, nil
+}
+
+func (s *Storage) SaveChatSettings(settings *ChatSettings) error {
+	_, err := s.db.Exec(`
+		insert into chat_settings (
+			chatId,
+			stickers
+		) values (
+			:chatId,
+			:stickers
+		)
+		on conflict (chatId) do update set
+			stickers = excluded.stickers;
+	`,
+		sql.Named("chatId", settings.ChatID),
+		sql.Named("stickers", settings.Stickers),
+	)
+	if err != nil {
+		return errors.Wrap(err, "saving chat settings")
+	}
+
+	return nil
+}
+
+// GetChatThresholds returns thresholds changed by chat admins by media name, empty if there are none
+func (s *Storage) GetChatThresholds(chatID int64) (map[string]int, error) {
+	rows, err := s.db.Query(`
+		select
+			media,
+			threshold
+		from chat_thresholds
+		where chatId = :chatId;
+	`, sql.Named("chatId", chatID))
+	if err != nil {
+		return nil, errors.Wrap(err, "querying chat thresholds")
+	}
+
+	return scanThresholds(rows)
+}
+
+func scanThresholds(rows *sql.Rows) (map[string]int, error) {
+	defer rows.Close()
+
+	thresholds := make(map[string]int)
+	for rows.Next() {
+		var media string
+		var threshold int
+		err := rows.Scan(&media, &threshold)
+		if err != nil {
+			return nil, errors.Wrap(err, "scanning chat threshold")
+		}
+
+		thresholds[media] = threshold
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "reading chat thresholds")
+	}
+
+	return thresholds, nil
+}
+
+// SaveChatThreshold sets the threshold of the media in the chat, 0 resets it to the default
+func (s *Storage) SaveChatThreshold(chatID int64, media string, threshold int) error {
+	var err error
+	if threshold == 0 {
+		_, err = s.db.Exec(`
+			delete from chat_thresholds
+			where chatId = :chatId
+			and media = :media;
+		`,
+			sql.Named("chatId", chatID),
+			sql.Named("media", media),
+		)
+	} else {
+		_, err = s.db.Exec(`
+			insert into chat_thresholds (
+				chatId,
+				media,
+				threshold
+			) values (
+				:chatId,
+				:media,
+				:threshold
+			)
+			on conflict (chatId, media) do update set
+				threshold = excluded.threshold;
+		`,
+			sql.Named("chatId", chatID),
+			sql.Named("media", media),
+			sql.Named("threshold", threshold),
+		)
+	}
+	if err != nil {
+		return errors.Wrap(err, "saving chat threshold")
+	}
+
+	return nil
+}
@@ -1,89 +1,60 @@
 package storage
 
 import (
-	"bytes"
 	"database/sql"
-	"encoding/gob"
+	"fmt"
 	"github.com/corona10/goimagehash"
 	"github.com/go-faster/errors"
 	"github.com/go-telegram/bot/models"
 	_ "github.com/mattn/go-sqlite3"
-	"io"
-	"sort"
 	"time"
 )
 
-type Storage struct {
-	db *sql.DB
-}
+// MediaKind separates media that should only be compared with the same kind
+type MediaKind int
+
+const (
+	// KindRegular is for photos, videos, animations and documents
+	KindRegular MediaKind = iota
+	// KindVideoNote is for round videos, their hashes are taken with the corners masked
+	KindVideoNote
+	// KindSticker is for all sticker formats, they are hashed as pictures or videos
+	KindSticker
+	// KindText is for long texts and captions, their SimHashes are in the texts table
+	KindText
+	// KindAudio is for voice messages and audio files, they have acoustic fingerprints
+	KindAudio
+)
 
-type MessagePicture struct {
-	ID       int
-	UserID   int
-	ChatID   int
-	SentDate time.Time
-	PHash    *goimagehash.ImageHash
-	DHash    *goimagehash.ImageHash
+// Media describes the file hashes were taken from
+type Media struct {
+	Kind         MediaKind
+	FileUniqueID string
+	// SHA256 is the hex encoded checksum of the downloaded file
+	SHA256 string
 }
 
-type VideoHashes struct {
-	FrameA *goimagehash.ImageHash
-	FrameB *goimagehash.ImageHash
-	FrameC *goimagehash.ImageHash
-	FrameD *goimagehash.ImageHash
+type Storage struct {
+	db    *sql.DB
+	index *hashIndex
 }
 
-// Dump method writes a binary serialization into w io.Writer.
-func (h *VideoHashes) Dump(w io.Writer) error {
-	type H struct {
-		Hash uint64
-		Kind goimagehash.Kind
-	}
-	type D struct {
-		FrameA H
-		FrameB H
-		FrameC H
-		FrameD H
-	}
-	enc := gob.NewEncoder(w)
-	err := enc.Encode(D{
-		FrameA: H{Hash: h.FrameA.GetHash(), Kind: h.FrameA.GetKind()},
-		FrameB: H{Hash: h.FrameB.GetHash(), Kind: h.FrameB.GetKind()},
-		FrameC: H{Hash: h.FrameC.GetHash(), Kind: h.FrameC.GetKind()},
-		FrameD: H{Hash: h.FrameD.GetHash(), Kind: h.FrameD.GetKind()},
-	})
-	if err != nil {
-		return err
-	}
-	return nil
+// VideoHashes are hashes of frames of a video in the order they are shown.
+// Frames are taken at scene changes, so every video has its own number of them.
+type VideoHashes struct {
+	PHashes []*goimagehash.ImageHash
+	DHashes []*goimagehash.ImageHash
+	// Times are when the frames are shown, from the start of the video
+	Times    []time.Duration
+	Duration time.Duration
 }
 
-// LoadVideoHashes method loads a VideoHashes from io.Reader.
-func LoadVideoHashes(b io.Reader) (*VideoHashes, error) {
-	type H struct {
-		Hash uint64
-		Kind goimagehash.Kind
-	}
-	type D struct {
-		FrameA H
-		FrameB H
-		FrameC H
-		FrameD H
-	}
-
-	var d D
-	dec := gob.NewDecoder(b)
-	err := dec.Decode(&d)
-	if err != nil {
-		return nil, err
+// senderID is the user who sent the message, 0 for channel posts and anonymous admins
+func senderID(msg *models.Message) int64 {
+	if msg.From == nil {
+		return 0
 	}
-
-	return &VideoHashes{
-		FrameA: goimagehash.NewImageHash(d.FrameA.Hash, d.FrameA.Kind),
-		FrameB: goimagehash.NewImageHash(d.FrameB.Hash, d.FrameB.Kind),
-		FrameC: goimagehash.NewImageHash(d.FrameC.Hash, d.FrameC.Kind),
-		FrameD: goimagehash.NewImageHash(d.FrameD.Hash, d.FrameD.Kind),
-	}, nil
+	return msg.From.ID
 }
 
 type Message struct {
@@ -93,299 +64,502 @@ type Message struct {
 	SentDate time.Time
 }
 
-type MessageVideo struct {
-	Msg     Message
-	PHashes VideoHashes
-	DHashes VideoHashes
-}
-
 type SimilarMessage struct {
 	Msg      *Message
 	Distance int
 }
 
-func New(filepath string) (*Storage, error) {
-	db, err := sql.Open("sqlite3", filepath)
+// SimilarVideo is a video found by FindVideosNear
+type SimilarVideo struct {
+	SimilarMessage
+	// Part is the part of the matched video the new one covers, nil if it covers all of it
+	Part *VideoPart
+}
+
+// VideoPart is where a clip cut from a video is in the video
+type VideoPart struct {
+	From, To time.Duration
+	// Duration is of the whole video
+	Duration time.Duration
+}
+
+// New opens the database. With useIndex, hashes are kept in memory for fast
+// similarity search, otherwise every search is a query to the database.
+func New(filepath string, useIndex bool) (*Storage, error) {
+	db, err := sql.Open(driverName, filepath)
 	if err != nil {
 		return nil, errors.Wrap(err, "opening sqlite database")
 	}
 
-	_, err = db.Exec(`
-		create table if not exists messages (
-			id integer not null,
-			userId integer not null,
-			chatId integer not null,
-			sentDate timestamp not null,
-			isVideo integer not null,
-			pHash blob not null,
-			dHash blob not null,
-			primary key (id, chatId)
-		);
-	`)
+	err = migrate(db, "", sqliteMigrations)
 	if err != nil {
-		return nil, errors.Wrap(err, "creating messages table")
+		return nil, errors.Wrap(err, "migrating database")
 	}
 
-	return &Storage{db}, nil
-}
+	s := &Storage{db: db}
+	if useIndex {
+		s.index = newHashIndex()
+		err = s.loadIndex("", nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "loading hash index")
+		}
 
-func (s *Storage) SaveMessagePicture(msg *models.Message, pHash *goimagehash.ImageHash, dHash *goimagehash.ImageHash) error {
-	var pHashDump bytes.Buffer
-	err := pHash.Dump(&pHashDump)
-	if err != nil {
-		return errors.Wrap(err, "dumping pHash")
+		err = s.loadTextIndex("", nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "loading text index")
+		}
 	}
 
-	var dHashDump bytes.Buffer
-	err = dHash.Dump(&dHashDump)
+	return s, nil
+}
+
+// SaveMessagePicture saves hashes of the picture and pHashes of its center crops
+func (s *Storage) SaveMessagePicture(msg *models.Message, media Media, pHash *goimagehash.ImageHash, dHash *goimagehash.ImageHash, crops []uint64) error {
+	tx, err := s.db.Begin()
 	if err != nil {
-		return errors.Wrap(err, "dumping dHash")
+		return errors.Wrap(err, "beginning transaction")
 	}
+	defer tx.Rollback()
 
-	_, err = s.db.Exec(`
+	res, err := tx.Exec(`
 		insert or ignore into messages (
 			id,
 			userId,
 			chatId,
 			sentDate,
 		    isVideo,
+			kind,
+			fileUniqueId,
+			sha256,
 			pHash,
-			dHash
+			dHash,
+			pHashKind,
+			dHashKind
 		) values (
 			:id,
 			:userId,
 			:chatId,
 			:sentDate,
 		    0,
+			:kind,
+			:fileUniqueId,
+			:sha256,
 			:pHash,
-			:dHash
+			:dHash,
+			:pHashKind,
+			:dHashKind
 		);`,
 		sql.Named("id", msg.ID),
-		sql.Named("userId", msg.From.ID),
+		sql.Named("kind", media.Kind),
+		sql.Named("fileUniqueId", media.FileUniqueID),
+		sql.Named("sha256", media.SHA256),
+		sql.Named("userId", senderID(msg)),
 		sql.Named("chatId", msg.Chat.ID),
 		sql.Named("sentDate", msg.Date),
-		sql.Named("pHash", pHashDump.Bytes()),
-		sql.Named("dHash", dHashDump.Bytes()),
+		sql.Named("pHash", int64(pHash.GetHash())),
+		sql.Named("dHash", int64(dHash.GetHash())),
+		sql.Named("pHashKind", pHash.GetKind()),
+		sql.Named("dHashKind", dHash.GetKind()),
 	)
 	if err != nil {
 		return errors.Wrap(err, "saving message to database")
 	}
 
-	return nil
+	err = saveCrops(tx, msg.Chat.ID, msg.ID, crops)
+	if err != nil {
+		return errors.Wrap(err, "saving crops")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "committing transaction")
+	}
+
+	return s.indexSaved(res, msg.Chat.ID, msg.ID)
 }
 
-// FindMsgPictureFilter finds messages in the database and applies a filter to them.
-// The filter function should return the distance between the hashes, whether
-// the message is a match and an error if any.
-// The messages are sorted by distance in descending order.
-// If limit is 0, all matches are returned.
-func (s *Storage) FindMsgPictureFilter(chatID int64, limit int, filter func(msg *MessagePicture) (dist int, ok bool, err error)) ([]*SimilarMessage, error) {
-	rows, err := s.db.Query(`
-		select
+// SaveMessageVideo saves hashes of the frames and the fingerprint of the sound, if the video has any.
+func (s *Storage) SaveMessageVideo(msg *models.Message, media Media, hashes *VideoHashes, audio *AudioTrack) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "beginning transaction")
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+		insert or ignore into messages (
 			id,
 			userId,
 			chatId,
 			sentDate,
-			pHash,
-			dHash
-		from messages
-		where chatId = :chatId
-		and isVideo = 0
-		order by id desc;
-	`, sql.Named("chatId", chatID))
+		    isVideo,
+			kind,
+			fileUniqueId,
+			sha256,
+			pHashKind,
+			dHashKind,
+			durationMs
+		) values (
+			:id,
+			:userId,
+			:chatId,
+			:sentDate,
+		    1,
+			:kind,
+			:fileUniqueId,
+			:sha256,
+			:pHashKind,
+			:dHashKind,
+			:durationMs
+		);`,
+		sql.Named("id", msg.ID),
+		sql.Named("kind", media.Kind),
+		sql.Named("fileUniqueId", media.FileUniqueID),
+		sql.Named("sha256", media.SHA256),
+		sql.Named("userId", senderID(msg)),
+		sql.Named("chatId", msg.Chat.ID),
+		sql.Named("sentDate", msg.Date),
+		sql.Named("pHashKind", hashes.PHashes[0].GetKind()),
+		sql.Named("dHashKind", hashes.DHashes[0].GetKind()),
+		sql.Named("durationMs", hashes.Duration.Milliseconds()),
+	)
 	if err != nil {
-		return nil, errors.Wrap(err, "querying messages")
+		return errors.Wrap(err, "saving message to database")
 	}
-	defer func() {
-		errClose := rows.Close()
-		if errClose != nil {
-			err = errors.Wrapf(err, "closing rows: %s", errClose)
-		}
-	}()
-
-	var messages []*SimilarMessage
-	for rows.Next() {
-		var msg MessagePicture
-		var pHashBytes, dHashBytes []byte
-		err := rows.Scan(
-			&msg.ID,
-			&msg.UserID,
-			&msg.ChatID,
-			&msg.SentDate,
-			&pHashBytes,
-			&dHashBytes,
-		)
-		if err != nil {
-			return nil, errors.Wrap(err, "scanning message")
-		}
-
-		dHash, err := goimagehash.LoadImageHash(bytes.NewReader(dHashBytes))
-		if err != nil {
-			return nil, errors.Wrap(err, "loading dHash")
-		}
-		pHash, err := goimagehash.LoadImageHash(bytes.NewReader(pHashBytes))
-		if err != nil {
-			return nil, errors.Wrap(err, "loading pHash")
-		}
 
-		msg.PHash = pHash
-		msg.DHash = dHash
+	err = saveVideoFrames(tx, msg.Chat.ID, msg.ID, hashes.sequence())
+	if err != nil {
+		return errors.Wrap(err, "saving frames")
+	}
 
-		dist, ok, err := filter(&msg)
+	if audio != nil && len(audio.Fingerprint) > 0 {
+		err = saveAudio(tx, msg, media, audio)
 		if err != nil {
-			return nil, errors.Wrap(err, "filtering message")
+			return errors.Wrap(err, "saving audio")
 		}
+	}
 
-		var sMsg SimilarMessage
-		sMsg.Msg = &Message{
-			ID:       msg.ID,
-			UserID:   msg.UserID,
-			ChatID:   msg.ChatID,
-			SentDate: msg.SentDate,
-		}
-		sMsg.Distance = dist
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "committing transaction")
+	}
 
-		if ok {
-			messages = append(messages, &sMsg)
-		}
+	return s.indexSaved(res, msg.Chat.ID, msg.ID)
+}
 
-		if limit != 0 && len(messages) >= limit {
-			break
-		}
+// SaveMessageCopy saves the message with hashes of the original one.
+// Used for exact copies, so they don't have to be downloaded and hashed.
+func (s *Storage) SaveMessageCopy(msg *models.Message, media Media, original *Message) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "beginning transaction")
 	}
+	defer tx.Rollback()
 
-	// Sort descending
-	sort.Slice(messages, func(i, j int) bool {
-		return messages[i].Distance > messages[j].Distance
-	})
-
-	return messages, nil
-}
+	res, err := tx.Exec(`
+		insert or ignore into messages (
+			id,
+			userId,
+			chatId,
+			sentDate,
+			isVideo,
+			kind,
+			fileUniqueId,
+			sha256,
+			pHash,
+			dHash,
+			pHashKind,
+			dHashKind,
+			durationMs
+		) select
+			:id,
+			:userId,
+			:chatId,
+			:sentDate,
+			isVideo,
+			:kind,
+			:fileUniqueId,
+			case when :sha256 = '' then sha256 else :sha256 end,
+			pHash,
+			dHash,
+			pHashKind,
+			dHashKind,
+			durationMs
+		from messages
+		where id = :originalId
+		and chatId = :originalChatId;`,
+		sql.Named("id", msg.ID),
+		sql.Named("userId", senderID(msg)),
+		sql.Named("chatId", msg.Chat.ID),
+		sql.Named("sentDate", msg.Date),
+		sql.Named("kind", media.Kind),
+		sql.Named("fileUniqueId", media.FileUniqueID),
+		sql.Named("sha256", media.SHA256),
+		sql.Named("originalId", original.ID),
+		sql.Named("originalChatId", original.ChatID),
+	)
+	if err != nil {
+		return errors.Wrap(err, "saving message copy to database")
+	}
 
-func (s *Storage) SaveMessageVideo(msg *models.Message, pHashes, dHashes *VideoHashes) error {
-	var pHashDump bytes.Buffer
-	err := pHashes.Dump(&pHashDump)
+	_, err = tx.Exec(`
+		insert or ignore into video_frames (
+			id,
+			chatId,
+			frame,
+			pHash,
+			dHash,
+			shownAtMs
+		) select
+			:id,
+			:chatId,
+			frame,
+			pHash,
+			dHash,
+			shownAtMs
+		from video_frames
+		where id = :originalId
+		and chatId = :originalChatId;`,
+		sql.Named("id", msg.ID),
+		sql.Named("chatId", msg.Chat.ID),
+		sql.Named("originalId", original.ID),
+		sql.Named("originalChatId", original.ChatID),
+	)
 	if err != nil {
-		return errors.Wrap(err, "dumping pHash")
+		return errors.Wrap(err, "saving frames copy to database")
 	}
 
-	var dHashDump bytes.Buffer
-	err = dHashes.Dump(&dHashDump)
+	_, err = tx.Exec(`
+		insert or ignore into picture_crops (
+			id,
+			chatId,
+			crop,
+			pHash
+		) select
+			:id,
+			:chatId,
+			crop,
+			pHash
+		from picture_crops
+		where id = :originalId
+		and chatId = :originalChatId;`,
+		sql.Named("id", msg.ID),
+		sql.Named("chatId", msg.Chat.ID),
+		sql.Named("originalId", original.ID),
+		sql.Named("originalChatId", original.ChatID),
+	)
 	if err != nil {
-		return errors.Wrap(err, "dumping dHash")
+		return errors.Wrap(err, "saving crops copy to database")
 	}
 
-	_, err = s.db.Exec(`
-		insert or ignore into messages (
+	_, err = tx.Exec(`
+		insert or ignore into audio (
 			id,
 			userId,
 			chatId,
 			sentDate,
-		    isVideo,
-			pHash,
-			dHash
-		) values (
+			kind,
+			fileUniqueId,
+			sha256,
+			duration,
+			fingerprint
+		) select
 			:id,
 			:userId,
 			:chatId,
 			:sentDate,
-		    1,
-			:pHash,
-			:dHash
-		);`,
+			kind,
+			:fileUniqueId,
+			case when :sha256 = '' then sha256 else :sha256 end,
+			duration,
+			fingerprint
+		from audio
+		where id = :originalId
+		and chatId = :originalChatId;`,
 		sql.Named("id", msg.ID),
-		sql.Named("userId", msg.From.ID),
+		sql.Named("userId", senderID(msg)),
 		sql.Named("chatId", msg.Chat.ID),
 		sql.Named("sentDate", msg.Date),
-		sql.Named("pHash", pHashDump.Bytes()),
-		sql.Named("dHash", dHashDump.Bytes()),
+		sql.Named("fileUniqueId", media.FileUniqueID),
+		sql.Named("sha256", media.SHA256),
+		sql.Named("originalId", original.ID),
+		sql.Named("originalChatId", original.ChatID),
 	)
 	if err != nil {
-		return errors.Wrap(err, "saving message to database")
+		return errors.Wrap(err, "saving audio copy to database")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "committing transaction")
+	}
+
+	return s.indexSaved(res, msg.Chat.ID, msg.ID)
+}
+
+// indexSaved adds the message to the index, unless it was already saved before
+func (s *Storage) indexSaved(res sql.Result, chatID int64, id int) error {
+	if s.index == nil {
+		return nil
+	}
+
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "getting affected rows")
+	}
+
+	if inserted == 0 {
+		return nil
+	}
+
+	err = s.indexMessage(chatID, id)
+	if err != nil {
+		return errors.Wrap(err, "indexing message")
 	}
 
 	return nil
 }
 
-func (s *Storage) FindMsgVideoFilter(chatID int64, limit int, filter func(msg *MessageVideo) (dist int, ok bool, err error)) ([]*SimilarMessage, error) {
-	rows, err := s.db.Query(`
+// FindMsgByFileUniqueID finds the first posted message of the given kind with exactly the same telegram file.
+// Returns nil if there is no such message.
+func (s *Storage) FindMsgByFileUniqueID(chatID int64, kind MediaKind, fileUniqueID string) (*SimilarMessage, error) {
+	return s.findExactMsg(chatID, kind, "fileUniqueId", fileUniqueID)
+}
+
+// FindMsgBySHA256 finds the first posted message of the given kind with a byte-for-byte equal file.
+// Returns nil if there is no such message.
+func (s *Storage) FindMsgBySHA256(chatID int64, kind MediaKind, sha256 string) (*SimilarMessage, error) {
+	return s.findExactMsg(chatID, kind, "sha256", sha256)
+}
+
+// exactTable is where files of the kind are looked up, voice messages and audio files
+// have no hashes and are only saved to the audio table
+func exactTable(kind MediaKind) string {
+	if kind == KindAudio {
+		return "audio"
+	}
+	return "messages"
+}
+
+func (s *Storage) findExactMsg(chatID int64, kind MediaKind, column, value string) (*SimilarMessage, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	var msg Message
+	err := s.db.QueryRow(fmt.Sprintf(`
 		select
 			id,
 			userId,
 			chatId,
-			sentDate,
-			pHash,
-			dHash
-		from messages
+			sentDate
+		from %s
 		where chatId = :chatId
-		and isVideo = 1
-		order by id desc;
-	`, sql.Named("chatId", chatID))
+		and kind = :kind
+		and %s = :value
+		order by sentDate, id
+		limit 1;
+	`, exactTable(kind), column),
+		sql.Named("chatId", chatID),
+		sql.Named("kind", kind),
+		sql.Named("value", value),
+	).Scan(
+		&msg.ID,
+		&msg.UserID,
+		&msg.ChatID,
+		&msg.SentDate,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
 	if err != nil {
-		return nil, errors.Wrap(err, "querying messages")
+		return nil, errors.Wrap(err, "querying message")
 	}
-	defer func() {
-		errClose := rows.Close()
-		if errClose != nil {
-			err = errors.Wrapf(err, "closing rows: %s", errClose)
-		}
-	}()
-
-	var messages []*SimilarMessage
-	for rows.Next() {
-		var msg MessageVideo
-		var pHashBytes, dHashBytes []byte
-		err := rows.Scan(
-			&msg.Msg.ID,
-			&msg.Msg.UserID,
-			&msg.Msg.ChatID,
-			&msg.Msg.SentDate,
-			&pHashBytes,
-			&dHashBytes,
+
+	return &SimilarMessage{Msg: &msg, Distance: 0}, nil
+}
+
+// deleteTables have messages identified by id and chatId
+var deleteTables = []string{"messages", "video_frames", "picture_crops", "audio", "texts", "forwards", "links", "clusters", "detections", "reviews"}
+
+// matchTables also reference older messages by matchId
+var matchTables = []string{"detections", "reviews"}
+
+func (s *Storage) DeleteMessage(chatID int64, id int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "beginning transaction")
+	}
+	defer tx.Rollback()
+
+	err = s.leaveCluster(tx, chatID, id)
+	if err != nil {
+		return err
+	}
+
+	for _, table := range deleteTables {
+		_, err = tx.Exec(
+			fmt.Sprintf("delete from %s where chatId = :chatId and id = :id;", table),
+			sql.Named("chatId", chatID),
+			sql.Named("id", id),
 		)
 		if err != nil {
-			return nil, errors.Wrap(err, "scanning message")
+			return errors.Wrapf(err, "deleting from %s", table)
 		}
+	}
 
-		dHash, err := LoadVideoHashes(bytes.NewReader(dHashBytes))
-		if err != nil {
-			return nil, errors.Wrap(err, "loading dHash")
-		}
-		pHash, err := LoadVideoHashes(bytes.NewReader(pHashBytes))
+	for _, table := range matchTables {
+		_, err = tx.Exec(
+			fmt.Sprintf("delete from %s where chatId = :chatId and matchId = :id;", table),
+			sql.Named("chatId", chatID),
+			sql.Named("id", id),
+		)
 		if err != nil {
-			return nil, errors.Wrap(err, "loading pHash")
+			return errors.Wrapf(err, "deleting from %s", table)
 		}
+	}
 
-		msg.DHashes = *dHash
-		msg.PHashes = *pHash
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "committing transaction")
+	}
 
-		dist, ok, err := filter(&msg)
-		if err != nil {
-			return nil, errors.Wrap(err, "filtering message")
-		}
+	if s.index != nil {
+		s.index.remove(chatID, func(msg Message) bool { return msg.ID == id })
+	}
 
-		var sMsg SimilarMessage
-		sMsg.Msg = &Message{
-			ID:       msg.Msg.ID,
-			UserID:   msg.Msg.UserID,
-			ChatID:   msg.Msg.ChatID,
-			SentDate: msg.Msg.SentDate,
-		}
-		sMsg.Distance = dist
+	return nil
+}
 
-		if ok {
-			messages = append(messages, &sMsg)
-		}
+func (s *Storage) DeleteChat(chatID int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "beginning transaction")
+	}
+	defer tx.Rollback()
 
-		if limit != 0 && len(messages) >= limit {
-			break
+	for _, table := range append(deleteTables, "chat_settings", "chat_thresholds") {
+		_, err = tx.Exec(
+			fmt.Sprintf("delete from %s where chatId = :chatId;", table),
+			sql.Named("chatId", chatID),
+		)
+		if err != nil {
+			return errors.Wrapf(err, "deleting from %s", table)
 		}
 	}
 
-	// Sort descending
-	sort.Slice(messages, func(i, j int) bool {
-		return messages[i].Distance > messages[j].Distance
-	})
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "committing transaction")
+	}
+
+	if s.index != nil {
+		s.index.remove(chatID, func(msg Message) bool { return true })
+	}
+
+	return nil
+}
 
-	return messages, nil
+func (s *Storage) Close() error {
+	return s.db.Close()
 }
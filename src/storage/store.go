@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"github.com/corona10/goimagehash"
+	"github.com/go-telegram/bot/models"
+	"time"
+)
+
+// Store is what the bot needs from a database. Storage keeps everything in a local
+// SQLite file, Postgres lets several instances of the bot share one database.
+// TestConformance checks that every implementation behaves the same.
+type Store interface {
+	// SaveMessagePicture saves hashes of the picture and pHashes of its center crops
+	SaveMessagePicture(msg *models.Message, media Media, pHash *goimagehash.ImageHash, dHash *goimagehash.ImageHash, crops []uint64) error
+	SaveMessageVideo(msg *models.Message, media Media, hashes *VideoHashes, audio *AudioTrack) error
+	SaveMessageText(msg *models.Message, simHash uint64) error
+	SaveMessageAudio(msg *models.Message, media Media, track *AudioTrack) error
+	SaveMessageCopy(msg *models.Message, media Media, original *Message) error
+
+	FindPicturesNear(chatID int64, kind MediaKind, hashType HashType, hash uint64, threshold, limit int) ([]*SimilarMessage, error)
+	FindVideosNear(chatID int64, kind MediaKind, hashType HashType, hashes *VideoHashes, threshold, limit int) ([]*SimilarVideo, error)
+	FindTextsNear(chatID int64, simHash uint64, threshold, limit int) ([]*SimilarMessage, error)
+	FindMsgAudioFilter(chatID int64, kind MediaKind, limit int, filter func(msg *MessageAudio) (dist int, ok bool, err error)) ([]*SimilarMessage, error)
+	GetAudioTrack(chatID int64, id int) (*AudioTrack, error)
+	FindMsgByFileUniqueID(chatID int64, kind MediaKind, fileUniqueID string) (*SimilarMessage, error)
+	FindMsgBySHA256(chatID int64, kind MediaKind, sha256 string) (*SimilarMessage, error)
+
+	SaveForward(msg *models.Message, origin *ForwardOrigin) error
+	FindForward(chatID int64, originKey string) (*SimilarMessage, error)
+
+	SaveLinks(msg *models.Message, links []string) error
+	FindLink(chatID int64, link string) (*SimilarMessage, error)
+
+	// JoinCluster adds the message to the clusters of the similar messages, merging them into one
+	JoinCluster(msg *models.Message, similar []*Message) error
+	// GetCluster returns the cluster of the message, or nil if it has no copies
+	GetCluster(chatID int64, id int) (*Cluster, error)
+
+	// SaveDetection saves a comparison of the message with the matched one
+	SaveDetection(msg *models.Message, match *Message, kind MediaKind, algorithm Algorithm, distance, threshold int, nearMiss bool) error
+	// GetDetections returns detections in the chat since the given time, newest first
+	GetDetections(chatID int64, since time.Time, limit int) ([]*Detection, error)
+	// GetMessageDetections returns detections where the message is either the new or the matched one
+	GetMessageDetections(chatID int64, id int) ([]*Detection, error)
+	// CountDetections counts detections in the chat since the given time by kind and algorithm
+	CountDetections(chatID int64, since time.Time) ([]*DetectionCount, error)
+
+	// SaveReview queues a comparison of the message with the matched one for review
+	SaveReview(msg *models.Message, match *Message, kind MediaKind, algorithm Algorithm, distance, threshold, score int) error
+	// GetReviews returns reviews queued in the chat, oldest first
+	GetReviews(chatID int64, limit int) ([]*Review, error)
+	// GetMessageReviews returns reviews of the new message, the most likely match first
+	GetMessageReviews(chatID int64, id int) ([]*Review, error)
+	// DeleteReviews removes reviews of the new message from the queue
+	DeleteReviews(chatID int64, id int) error
+
+	GetChatSettings(chatID int64) (*ChatSettings, error)
+	SaveChatSettings(settings *ChatSettings) error
+	// GetChatThresholds returns thresholds changed by chat admins by media name
+	GetChatThresholds(chatID int64) (map[string]int, error)
+	// SaveChatThreshold sets the threshold of the media in the chat, 0 resets it to the default
+	SaveChatThreshold(chatID int64, media string, threshold int) error
+
+	// DeleteMessage forgets everything saved about the message
+	DeleteMessage(chatID int64, id int) error
+	// DeleteChat forgets everything saved about the chat, including its settings
+	DeleteChat(chatID int64) error
+
+	Close() error
+}
+
+var (
+	_ Store = (*Storage)(nil)
+	_ Store = (*Postgres)(nil)
+)
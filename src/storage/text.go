@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"database/sql"
+	"github.com/go-faster/errors"
+	"github.com/go-telegram/bot/models"
+)
+
+// SaveMessageText saves the SimHash of a long text or caption. Texts have their own table,
+// a caption belongs to a message that has media saved too.
+func (s *Storage) SaveMessageText(msg *models.Message, simHash uint64) error {
+	res, err := s.db.Exec(`
+		insert or ignore into texts (
+			id,
+			userId,
+			chatId,
+			sentDate,
+			simHash
+		) values (
+			:id,
+			:userId,
+			:chatId,
+			:sentDate,
+			:simHash
+		);`,
+		sql.Named("id", msg.ID),
+		sql.Named("userId", senderID(msg)),
+		sql.Named("chatId", msg.Chat.ID),
+		sql.Named("sentDate", msg.Date),
+		sql.Named("simHash", int64(simHash)),
+	)
+	if err != nil {
+		return errors.Wrap(err, "saving text to database")
+	}
+
+	if s.index == nil {
+		return nil
+	}
+
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "getting affected rows")
+	}
+
+	if inserted == 0 {
+		return nil
+	}
+
+	err = s.loadTextIndex("and m.id = :id and m.chatId = :chatId", []any{
+		sql.Named("id", msg.ID),
+		sql.Named("chatId", msg.Chat.ID),
+	})
+	if err != nil {
+		return errors.Wrap(err, "indexing text")
+	}
+
+	return nil
+}
+
+// FindTextsNear works like FindPicturesNear, but for texts.
+func (s *Storage) FindTextsNear(chatID int64, simHash uint64, threshold, limit int) ([]*SimilarMessage, error) {
+	if s.index != nil {
+		key := indexKey{chatID: chatID, kind: KindText, hash: HashPerception}
+		return s.index.nearest(key, []uint64{simHash}, threshold, limit), nil
+	}
+
+	rows, err := s.db.Query(`
+		select
+			id,
+			userId,
+			chatId,
+			sentDate,
+			hamming(simHash, :hash) as distance
+		from texts
+		where chatId = :chatId
+		and hamming(simHash, :hash) < :threshold
+		order by distance, sentDate, id
+		limit :limit;`,
+		sql.Named("chatId", chatID),
+		sql.Named("hash", int64(simHash)),
+		sql.Named("threshold", threshold),
+		sql.Named("limit", sqlLimit(limit)),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "querying texts")
+	}
+
+	return scanSimilar(rows)
+}
+
+// loadTextIndex works like loadIndex for the texts table
+func (s *Storage) loadTextIndex(filter string, args []any) error {
+	rows, err := s.db.Query(`
+		select
+			m.id,
+			m.userId,
+			m.chatId,
+			m.sentDate,
+			m.simHash
+		from texts m
+		where 1 = 1
+		`+filter+`;
+	`, args...)
+	if err != nil {
+		return errors.Wrap(err, "querying texts")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var msg Message
+		var simHash int64
+		err = rows.Scan(
+			&msg.ID,
+			&msg.UserID,
+			&msg.ChatID,
+			&msg.SentDate,
+			&simHash,
+		)
+		if err != nil {
+			return errors.Wrap(err, "scanning text")
+		}
+
+		key := indexKey{chatID: int64(msg.ChatID), kind: KindText, hash: HashPerception}
+		s.index.insert(key, []uint64{uint64(simHash)}, msg)
+	}
+	if err = rows.Err(); err != nil {
+		return errors.Wrap(err, "reading texts")
+	}
+
+	return nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"github.com/go-faster/errors"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"github.com/sleroq/bayan/src/storage"
+	"hash/fnv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// shingleSize is the length of character n-grams the SimHash is built from
+const shingleSize = 5
+
+// normalizeText lowercases the text and keeps only letters and digits separated by single spaces,
+// so whitespace, punctuation and emoji don't change the fingerprint
+func normalizeText(text string) []rune {
+	var normalized []rune
+	space := true
+	for _, r := range strings.ToLower(text) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			normalized = append(normalized, r)
+			space = false
+			continue
+		}
+
+		if !space {
+			normalized = append(normalized, ' ')
+			space = true
+		}
+	}
+
+	if len(normalized) > 0 && normalized[len(normalized)-1] == ' ' {
+		normalized = normalized[:len(normalized)-1]
+	}
+
+	return normalized
+}
+
+// simHash returns a 64-bit SimHash of character shingles of the text.
+// Small edits change only a few shingles, so similar texts get hashes with small Hamming distance.
+func simHash(text string) uint64 {
+	normalized := normalizeText(text)
+	if len(normalized) < shingleSize {
+		return 0
+	}
+
+	var weights [64]int
+	for i := 0; i+shingleSize <= len(normalized); i++ {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(string(normalized[i : i+shingleSize])))
+		sum := h.Sum64()
+
+		for bit := 0; bit < 64; bit++ {
+			if sum&(1<<bit) != 0 {
+				weights[bit]++
+			} else {
+				weights[bit]--
+			}
+		}
+	}
+
+	var hash uint64
+	for bit := 0; bit < 64; bit++ {
+		if weights[bit] > 0 {
+			hash |= 1 << bit
+		}
+	}
+
+	return hash
+}
+
+// messageText is the text of the message, or the caption of its media
+func messageText(msg *models.Message) string {
+	if msg.Text != "" {
+		return msg.Text
+	}
+	return msg.Caption
+}
+
+func (b *BayanBot) isLongText(text string) bool {
+	return b.textMinLength > 0 && utf8.RuneCountInString(text) >= b.textMinLength
+}
+
+func (b *BayanBot) findText(msg *models.Message) (similar []*match, save func() error, err error) {
+	hash := simHash(messageText(msg))
+
+	save = func() error {
+		err := b.store.SaveMessageText(msg, hash)
+		if err != nil {
+			return errors.Wrap(err, "failed to save message")
+		}
+
+		return nil
+	}
+
+	threshold, err := b.threshold(msg.Chat.ID, mediaText)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	found, err := b.store.FindTextsNear(msg.Chat.ID, hash, searchThreshold(threshold), 0)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to find similar messages")
+	}
+	similar = b.splitByConfidence(msg, detectedBy(matched(found...), storage.KindText, storage.AlgorithmSimHash, threshold))
+
+	return similar, save, nil
+}
+
+func (b *BayanBot) processText(ctx context.Context, api *bot.Bot, msg *models.Message) error {
+	similar, save, err := b.findText(msg)
+	if err != nil {
+		return err
+	}
+
+	if len(similar) > 0 {
+		err := b.replyBayan(ctx, api, msg, similar...)
+		if err != nil {
+			return errors.Wrap(err, "failed to reply bayan")
+		}
+	}
+
+	return save()
+}
+
+func (b *BayanBot) compareText(ctx context.Context, api *bot.Bot, msg *models.Message) error {
+	text := messageText(msg.ReplyToMessage)
+	if b.textMinLength == 0 {
+		b.reply(ctx, api, msg, "Проверка текстов выключена")
+		return nil
+	}
+	if !b.isLongText(text) {
+		b.reply(ctx, api, msg, "Текст слишком короткий, чтобы сравнивать")
+		return nil
+	}
+
+	hash := simHash(text)
+
+	threshold, err := b.threshold(msg.Chat.ID, mediaText)
+	if err != nil {
+		return err
+	}
+
+	found, err := b.store.FindTextsNear(msg.Chat.ID, hash, threshold, 0)
+	if err != nil {
+		return errors.Wrap(err, "failed to find similar messages")
+	}
+	similar := excludeMessage(matched(found...), msg.ReplyToMessage.ID)
+
+	if len(similar) > 0 {
+		err := b.replySimilar(ctx, api, msg, similar)
+		if err != nil {
+			return errors.Wrap(err, "failed to reply bayan")
+		}
+	} else {
+		b.reply(ctx, api, msg, "Похожих постов не видел")
+	}
+
+	return nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-faster/errors"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"github.com/sleroq/bayan/src/storage"
+	"go.uber.org/zap"
+	"strconv"
+	"strings"
+)
+
+// thresholdMedia names media with their own similarity threshold
+type thresholdMedia string
+
+const (
+	// mediaPhoto is the max pHash distance of pictures, documents and thumbnails of big videos
+	mediaPhoto thresholdMedia = "photo"
+	// mediaVideo is the max average pHash distance of video frames
+	mediaVideo thresholdMedia = "video"
+	// mediaVideoNote is like mediaVideo for round videos
+	mediaVideoNote thresholdMedia = "videonote"
+	// mediaSticker is for all sticker formats, they are compared as pictures or videos
+	mediaSticker thresholdMedia = "sticker"
+	// mediaText is the max number of differing SimHash bits
+	mediaText thresholdMedia = "text"
+	// mediaAudio is the max bit error rate in percents of voice messages and audio files
+	mediaAudio thresholdMedia = "audio"
+)
+
+// thresholdMediaList is the order thresholds are listed in
+var thresholdMediaList = []thresholdMedia{mediaPhoto, mediaVideo, mediaVideoNote, mediaSticker, mediaText, mediaAudio}
+
+// maxThresholds are the biggest possible distances, hashes have 64 bits and audio distance is in percents
+var maxThresholds = map[thresholdMedia]int{
+	mediaPhoto:     64,
+	mediaVideo:     64,
+	mediaVideoNote: 64,
+	mediaSticker:   64,
+	mediaText:      64,
+	mediaAudio:     100,
+}
+
+// mediaOf returns the threshold name of media of the kind
+func mediaOf(kind storage.MediaKind, isVideo bool) thresholdMedia {
+	switch kind {
+	case storage.KindSticker:
+		return mediaSticker
+	case storage.KindVideoNote:
+		return mediaVideoNote
+	case storage.KindText:
+		return mediaText
+	case storage.KindAudio:
+		return mediaAudio
+	}
+
+	if isVideo {
+		return mediaVideo
+	}
+	return mediaPhoto
+}
+
+// validThreshold checks that the threshold can be used for the media
+func validThreshold(media thresholdMedia, threshold int) error {
+	if threshold < 1 || threshold > maxThresholds[media] {
+		return errors.Errorf("threshold of %s must be from 1 to %d", media, maxThresholds[media])
+	}
+	return nil
+}
+
+// threshold returns the threshold of the media in the chat, or the default if admins never changed it
+func (b *BayanBot) threshold(chatID int64, media thresholdMedia) (int, error) {
+	thresholds, err := b.store.GetChatThresholds(chatID)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to get chat thresholds")
+	}
+
+	if threshold, ok := thresholds[string(media)]; ok {
+		return threshold, nil
+	}
+
+	return b.thresholds[media], nil
+}
+
+// compareThreshold is the dHash threshold /compare uses for pictures and videos,
+// it's looser than the threshold, so less similar posts are listed too
+func compareThreshold(threshold int) int {
+	return threshold + threshold/2
+}
+
+// thresholdCmd shows thresholds of the chat and lets admins change them:
+// /threshold <media> <value|default>
+func (b *BayanBot) thresholdCmd(ctx context.Context, api *bot.Bot, update *models.Update) {
+	msg := update.Message
+	args := strings.Fields(msg.Text)
+	if len(args) < 3 {
+		thresholds, err := b.store.GetChatThresholds(msg.Chat.ID)
+		if err != nil {
+			b.logger.Error("failed to get chat thresholds", zap.Error(err))
+			return
+		}
+
+		text := "Пороги похожести, чем меньше, тем строже:\n"
+		for _, media := range thresholdMediaList {
+			if threshold, ok := thresholds[string(media)]; ok {
+				text += fmt.Sprintf("%s: %d\n", media, threshold)
+			} else {
+				text += fmt.Sprintf("%s: %d (по умолчанию)\n", media, b.thresholds[media])
+			}
+		}
+		text += "\nИзменить: /threshold photo 8\nСбросить: /threshold photo default"
+
+		b.reply(ctx, api, msg, text)
+		return
+	}
+
+	isAdmin, err := b.isChatAdmin(ctx, api, msg)
+	if err != nil {
+		b.logger.Error("failed to check admin rights", zap.Error(err))
+		return
+	}
+	if !isAdmin {
+		b.reply(ctx, api, msg, "Менять настройки могут только админы")
+		return
+	}
+
+	media := thresholdMedia(args[1])
+	if _, ok := maxThresholds[media]; !ok {
+		names := make([]string, len(thresholdMediaList))
+		for i, m := range thresholdMediaList {
+			names[i] = string(m)
+		}
+		b.reply(ctx, api, msg, "Не знаю такой тип, есть: "+strings.Join(names, ", "))
+		return
+	}
+
+	threshold := 0
+	if args[2] != "default" {
+		threshold, err = strconv.Atoi(args[2])
+		if err == nil {
+			err = validThreshold(media, threshold)
+		}
+		if err != nil {
+			b.reply(ctx, api, msg, fmt.Sprintf("Порог для %s должен быть числом от 1 до %d или default", media, maxThresholds[media]))
+			return
+		}
+	}
+
+	err = b.store.SaveChatThreshold(msg.Chat.ID, string(media), threshold)
+	if err != nil {
+		b.logger.Error("failed to save chat threshold", zap.Error(err))
+		return
+	}
+
+	if threshold == 0 {
+		b.reply(ctx, api, msg, fmt.Sprintf("Порог для %s сброшен до %d", media, b.thresholds[media]))
+	} else {
+		b.reply(ctx, api, msg, fmt.Sprintf("Порог для %s: %d", media, threshold))
+	}
+}
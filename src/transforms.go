@@ -0,0 +1,111 @@
+package main
+
+import (
+	"github.com/corona10/goimagehash"
+	"github.com/go-faster/errors"
+	"image"
+)
+
+// transform is how a repost was flipped or rotated to dodge detection.
+// New pictures are hashed transformed too, so they match the original.
+type transform string
+
+const (
+	transformMirror    transform = "mirror"
+	transformFlip      transform = "flip"
+	transformRotate90  transform = "rotate90"
+	transformRotate180 transform = "rotate180"
+	transformRotate270 transform = "rotate270"
+)
+
+// transforms are checked besides the picture as it is
+var transforms = []transform{transformMirror, transformFlip, transformRotate90, transformRotate180, transformRotate270}
+
+// title is how the reply calls a repost with the transform
+func (t transform) title() string {
+	switch t {
+	case transformMirror:
+		return "зеркальный баян"
+	case transformFlip:
+		return "перевёрнутый зеркальный баян"
+	case transformRotate180:
+		return "перевёрнутый баян"
+	default:
+		return "повёрнутый баян"
+	}
+}
+
+// apply returns a transformed copy of the image. Rotations are clockwise.
+func (t transform) apply(src *image.RGBA) *image.RGBA {
+	width, height := src.Rect.Dx(), src.Rect.Dy()
+	rect := image.Rect(0, 0, width, height)
+	if t == transformRotate90 || t == transformRotate270 {
+		rect = image.Rect(0, 0, height, width)
+	}
+
+	dst := image.NewRGBA(rect)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var dx, dy int
+			switch t {
+			case transformMirror:
+				dx, dy = width-1-x, y
+			case transformFlip:
+				dx, dy = x, height-1-y
+			case transformRotate90:
+				dx, dy = height-1-y, x
+			case transformRotate180:
+				dx, dy = width-1-x, height-1-y
+			case transformRotate270:
+				dx, dy = y, width-1-x
+			}
+
+			from := src.PixOffset(src.Rect.Min.X+x, src.Rect.Min.Y+y)
+			to := dst.PixOffset(dx, dy)
+			copy(dst.Pix[to:to+4], src.Pix[from:from+4])
+		}
+	}
+
+	return dst
+}
+
+// variantHashes are hashes of a transformed picture or video frame
+type variantHashes struct {
+	transform    transform
+	pHash, dHash *goimagehash.ImageHash
+}
+
+// hashVariants returns hashes of every transform of the image
+func hashVariants(img image.Image) ([]variantHashes, error) {
+	rgba, ok := img.(*image.RGBA)
+	if !ok {
+		rgba = cropImage(img, img.Bounds())
+	}
+
+	variants := make([]variantHashes, len(transforms))
+	for i, t := range transforms {
+		transformed := t.apply(rgba)
+
+		pHash, err := goimagehash.PerceptionHash(transformed)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get perception hash")
+		}
+
+		dHash, err := goimagehash.DifferenceHash(transformed)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get difference hash")
+		}
+
+		variants[i] = variantHashes{transform: t, pHash: pHash, dHash: dHash}
+	}
+
+	return variants, nil
+}
+
+// transformedBy marks messages found by hashes of the transformed picture
+func transformedBy(similar []*match, t transform) []*match {
+	for _, s := range similar {
+		s.transform = t
+	}
+	return similar
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"github.com/corona10/goimagehash"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// inverse undoes the transform
+var inverse = map[transform]transform{
+	transformMirror:    transformMirror,
+	transformFlip:      transformFlip,
+	transformRotate90:  transformRotate270,
+	transformRotate180: transformRotate180,
+	transformRotate270: transformRotate90,
+}
+
+// gradientImage has no symmetry, so every transform of it looks different
+func gradientImage(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetRGBA(x, y, color.RGBA{R: uint8(x * 255 / width), G: uint8(y * 255 / height), B: uint8((x * y) % 256), A: 0xff})
+		}
+	}
+	return img
+}
+
+func TestTransformApply(t *testing.T) {
+	img := gradientImage(3, 2)
+	corner := img.RGBAAt(0, 0)
+
+	tests := []struct {
+		transform transform
+		size      image.Point
+		corner    image.Point
+	}{
+		{transformMirror, image.Pt(3, 2), image.Pt(2, 0)},
+		{transformFlip, image.Pt(3, 2), image.Pt(0, 1)},
+		{transformRotate90, image.Pt(2, 3), image.Pt(1, 0)},
+		{transformRotate180, image.Pt(3, 2), image.Pt(2, 1)},
+		{transformRotate270, image.Pt(2, 3), image.Pt(0, 2)},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.transform), func(t *testing.T) {
+			got := tt.transform.apply(img)
+			if got.Rect.Size() != tt.size {
+				t.Errorf("got size %v, want %v", got.Rect.Size(), tt.size)
+			}
+			if got.RGBAAt(tt.corner.X, tt.corner.Y) != corner {
+				t.Errorf("top left pixel is not at %v", tt.corner)
+			}
+
+			back := inverse[tt.transform].apply(got)
+			if string(back.Pix) != string(img.Pix) {
+				t.Errorf("%s doesn't undo it", inverse[tt.transform])
+			}
+		})
+	}
+}
+
+func TestHashVariants(t *testing.T) {
+	img := gradientImage(64, 48)
+	want, err := goimagehash.PerceptionHash(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tr := range transforms {
+		t.Run(string(tr), func(t *testing.T) {
+			variants, err := hashVariants(tr.apply(img))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The repost transformed back is the original
+			for _, variant := range variants {
+				if variant.transform == inverse[tr] && variant.pHash.GetHash() != want.GetHash() {
+					t.Errorf("%s variant: got pHash %x, want %x", variant.transform, variant.pHash.GetHash(), want.GetHash())
+				}
+			}
+		})
+	}
+}